@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"text/tabwriter"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fromFlag   string
+	sha256Flag string
+)
+
+var codeqlCmd = &cobra.Command{
+	Use:   "codeql",
+	Short: "Manage CodeQL CLI distributions.",
+	Long: `Manage CodeQL CLI distributions.
+
+Distributions are installed in the gh-mrva config directory. The distribution
+selected with 'codeql use' is used by every command running CodeQL, unless
+--codeql-cli or the codeql_cli config option select another CLI.`,
+	// the distributions are managed here, so a broken selection must not
+	// prevent fixing it
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupConfig(cmd); err != nil {
+			return err
+		}
+		return utils.SetProfile(utils.ResolveProfile(profileFlag, ""))
+	},
+}
+
+var codeqlInstallCmd = &cobra.Command{
+	Use:   "install <version>",
+	Short: "Install a CodeQL CLI distribution.",
+	Long: `Install a CodeQL CLI distribution.
+
+The archive is downloaded from the codeql_mirror config option, a URL template
+using {{.Version}} and {{.Platform}} that defaults to the CodeQL CLI releases on
+GitHub, or read from the archive or URL given with --from. The SHA-256 checksum
+of the archive is verified against --sha256 or, if not given, against the
+.checksum.txt file published next to the archive.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		installCodeQL(args[0])
+	},
+}
+
+var codeqlUseCmd = &cobra.Command{
+	Use:   "use <version>|system",
+	Short: "Select the CodeQL CLI distribution to use.",
+	Long: `Select the CodeQL CLI distribution to use.
+
+Use 'system' to go back to the codeql found in PATH.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		useCodeQL(args[0])
+	},
+}
+
+var codeqlLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the installed CodeQL CLI distributions.",
+	Long:  `List the installed CodeQL CLI distributions.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listCodeQL()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(codeqlCmd)
+	codeqlCmd.AddCommand(codeqlInstallCmd)
+	codeqlCmd.AddCommand(codeqlUseCmd)
+	codeqlCmd.AddCommand(codeqlLsCmd)
+	codeqlInstallCmd.Flags().StringVarP(&fromFlag, "from", "", "", "Local archive or URL of the distribution (overrides config file)")
+	codeqlInstallCmd.Flags().StringVarP(&sha256Flag, "sha256", "", "", "Expected SHA-256 checksum of the archive")
+	codeqlLsCmd.Flags().BoolVarP(&jsonFlag, "json", "j", false, "Output in JSON format (default: false)")
+}
+
+func installCodeQL(version string) {
+	if err := utils.ValidateVersion(version); err != nil {
+		log.Fatal(err)
+	}
+	source := fromFlag
+	if source == "" {
+		var err error
+		source, err = utils.CodeQLArchiveURL(utils.ResolveCodeQLMirror(), version)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	utils.Printf("Installing CodeQL %s from %s\n", version, source)
+	if utils.IsURL(source) {
+		utils.StartProgress("Downloading", 1, utils.IsInteractive())
+	}
+	distribution, err := utils.InstallCodeQLDistribution(version, source, sha256Flag)
+	if utils.IsURL(source) {
+		utils.CompleteProgressTask("Downloaded CodeQL "+version, err)
+		utils.StopProgress()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.Printf("Installed CodeQL %s in %s\n", distribution.Version, distribution.Path)
+	utils.EmitEvent(models.Event{Type: utils.CodeQLInstalledEvent, Files: []string{distribution.Path}, Data: distribution})
+	if utils.GetSelectedCodeQLVersion() == "" {
+		utils.Printf("Use 'gh mrva codeql use %s' to select it\n", distribution.Version)
+	}
+}
+
+func useCodeQL(version string) {
+	if version == "system" {
+		if err := utils.SelectCodeQLDistribution(""); err != nil {
+			log.Fatal(err)
+		}
+		utils.Println("Using the CodeQL CLI found in PATH")
+		utils.EmitEvent(models.Event{Type: utils.CodeQLSelectedEvent, Data: map[string]string{"version": "system"}})
+		return
+	}
+	if err := utils.ValidateVersion(version); err != nil {
+		log.Fatal(err)
+	}
+	if err := utils.SelectCodeQLDistribution(version); err != nil {
+		log.Fatal(err)
+	}
+	utils.Printf("Using CodeQL %s\n", version)
+	utils.EmitEvent(models.Event{Type: utils.CodeQLSelectedEvent, Data: map[string]string{"version": version}})
+}
+
+func listCodeQL() {
+	distributions, err := utils.ListCodeQLDistributions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonFlag || utils.JSONOutput() {
+		if err := utils.PrintJSON(distributions); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(distributions) == 0 {
+		utils.Println("No CodeQL distributions installed")
+		return
+	}
+	w := tabwriter.NewWriter(utils.Out(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tVERSION\tINSTALLED\tSOURCE")
+	for _, distribution := range distributions {
+		selected := ""
+		if distribution.Selected {
+			selected = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", selected, distribution.Version, distribution.InstalledAt.Format("2006-01-02"), distribution.Source)
+	}
+	w.Flush()
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"github.com/spf13/cobra"
+)
+
+var projectFlag bool
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Get, set and validate config options.",
+	Long: `Get, set and validate config options.
+
+Each option is taken from the first of these layers that sets it:
+
+  1. command line flags
+  2. GH_MRVA_* environment variables, e.g. GH_MRVA_LIST_FILE for list_file
+  3. the profile selected with --profile or GH_MRVA_PROFILE
+  4. the project config file, ` + config.PROJECT_CONFIG_FILE + `, in the working directory or a parent
+  5. the user config file, config.yml in the gh-mrva config directory
+  6. the defaults`,
+	// the config is managed here, so a broken config must not prevent fixing it
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupConfig(cmd)
+	},
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Print the effective value of a config option.",
+	Long:  `Print the effective value of a config option.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		getConfigOption(args[0])
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set <key> <value>",
+	Short: "Set a config option in the user or project config file.",
+	Long: `Set a config option in the user config file or, with --project, in the
+project config file. With --profile, the option is set in that profile. An
+empty value removes the option.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		setConfigOption(args[0], args[1])
+	},
+}
+
+var configListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the effective config options and where they come from.",
+	Long:  `List the effective config options and where they come from.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listConfigOptions()
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the config files and environment variables.",
+	Long:  `Validate the config files and environment variables.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		validateConfig()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configListCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configSetCmd.Flags().BoolVarP(&projectFlag, "project", "", false, "Set the option in the project config file (default: user config file)")
+	configListCmd.Flags().BoolVarP(&jsonFlag, "json", "j", false, "Output in JSON format (default: false)")
+}
+
+// loadConfig loads the config with the profile selected with --profile or
+// GH_MRVA_PROFILE applied.
+func loadConfig() (models.Config, map[string]string) {
+	if err := utils.SetProfile(utils.ResolveProfile(profileFlag, "")); err != nil {
+		log.Fatal(err)
+	}
+	configData, sources, err := utils.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return configData, sources
+}
+
+func getConfigOption(key string) {
+	configData, sources := loadConfig()
+	value, err := utils.GetConfigValue(configData, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if utils.JSONOutput() {
+		if err := utils.PrintJSON(models.ConfigSetting{Key: key, Value: value, Source: sources[key]}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	utils.Println(value)
+}
+
+func setConfigOption(key string, value string) {
+	path := utils.GetConfigFilePath()
+	if projectFlag {
+		path = utils.FindProjectConfigFile()
+		if path == "" {
+			path = config.PROJECT_CONFIG_FILE
+		}
+	}
+	err := utils.SetConfigFileValue(path, profileFlag, key, value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	if value == "" {
+		utils.Printf("Removed %s from %s\n", key, path)
+	} else {
+		utils.Printf("Set %s to %s in %s\n", key, value, path)
+	}
+	utils.EmitEvent(models.Event{Type: utils.ConfigSetEvent, Files: []string{path}, Data: models.ConfigSetting{Key: key, Value: value}})
+}
+
+func listConfigOptions() {
+	configData, sources := loadConfig()
+	var settings []models.ConfigSetting
+	for _, key := range utils.ConfigKeys() {
+		value, _ := utils.GetConfigValue(configData, key)
+		settings = append(settings, models.ConfigSetting{Key: key, Value: value, Source: sources[key]})
+	}
+	if jsonFlag || utils.JSONOutput() {
+		if err := utils.PrintJSON(settings); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(utils.Out(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, setting := range settings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", setting.Key, setting.Value, setting.Source)
+	}
+	w.Flush()
+	if projectFile := utils.FindProjectConfigFile(); projectFile != "" {
+		utils.Printf("\nProject config: %s\n", projectFile)
+	}
+}
+
+func validateConfig() {
+	valid := true
+	files := []string{utils.GetConfigFilePath()}
+	if projectFile := utils.FindProjectConfigFile(); projectFile != "" {
+		files = append(files, projectFile)
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		errs := utils.ValidateConfigFile(file)
+		for _, err := range errs {
+			utils.EmitError(err)
+			utils.Println(err)
+		}
+		if len(errs) > 0 {
+			valid = false
+		} else {
+			utils.Printf("%s is valid\n", file)
+		}
+	}
+	for _, err := range utils.ValidateConfigEnv() {
+		utils.EmitError(err)
+		utils.Println(err)
+		valid = false
+	}
+	if !valid {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,346 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"github.com/cli/go-gh/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var (
+	olderThanFlag int
+	allFlag       bool
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the shared database cache.",
+	Long: `Manage the shared database cache.
+
+Databases downloaded with 'download --download-dbs' are stored once per repository,
+language and commit in the database cache and linked into each output directory.`,
+}
+
+var dbLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List cached databases.",
+	Long:  `List cached databases.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listDatabases()
+	},
+}
+
+var dbPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove outdated databases from the cache.",
+	Long: `Remove outdated databases from the cache.
+
+By default only the latest database of each repository and language is kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pruneDatabases()
+	},
+}
+
+var dbDownloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Download the databases of a repository list into the cache.",
+	Long: `Download the databases of a repository list into the cache.
+
+The databases metadata is fetched first to report which repositories have no
+database for the language and how large the downloads are.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		downloadDatabases()
+	},
+}
+
+var dbExtractCmd = &cobra.Command{
+	Use:   "extract",
+	Short: "Extract cached databases and validate them.",
+	Long: `Extract cached databases and validate them with 'codeql resolve database'.
+
+Extracts the latest cached database of each repository, or only the ones
+matching --nwo and --language.`,
+	PreRunE: setupCodeQLCLI,
+	Run: func(cmd *cobra.Command, args []string) {
+		extractDatabases()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbLsCmd)
+	dbCmd.AddCommand(dbPruneCmd)
+	dbCmd.AddCommand(dbExtractCmd)
+	dbCmd.AddCommand(dbDownloadCmd)
+	dbLsCmd.Flags().BoolVarP(&jsonFlag, "json", "j", false, "Output in JSON format (default: false)")
+	dbLsCmd.Flags().StringVarP(&nwoFlag, "nwo", "n", "", "Only list databases for this repository")
+	dbLsCmd.Flags().StringVarP(&languageFlag, "language", "l", "", "Only list databases for this language")
+	dbPruneCmd.Flags().IntVarP(&olderThanFlag, "older-than", "", 0, "Also remove the latest databases if they were downloaded more than this many days ago")
+	dbPruneCmd.Flags().BoolVarP(&allFlag, "all", "", false, "Remove all cached databases")
+	dbDownloadCmd.Flags().StringVarP(&listFlag, "list", "i", "", "Name of repo list")
+	dbDownloadCmd.Flags().StringVarP(&listFileFlag, "list-file", "f", "", "Path to repo list file (overrides config file)")
+	dbDownloadCmd.Flags().StringVarP(&nwoFlag, "nwo", "n", "", "Repository to download the database for")
+	dbDownloadCmd.Flags().StringVarP(&languageFlag, "language", "l", "", "DB language")
+	dbDownloadCmd.Flags().StringVarP(&outputDirFlag, "output-dir", "o", "", "Also link the databases into this directory (optional)")
+	dbDownloadCmd.Flags().StringVarP(&layoutFlag, "layout", "", "", "Template for the database paths relative to the output directory (overrides config file)")
+	addDownloadLimitFlags(dbDownloadCmd)
+	dbDownloadCmd.MarkFlagRequired("language")
+	dbDownloadCmd.MarkFlagsMutuallyExclusive("list", "nwo")
+	dbExtractCmd.Flags().StringVarP(&nwoFlag, "nwo", "n", "", "Only extract databases for this repository")
+	dbExtractCmd.Flags().StringVarP(&languageFlag, "language", "l", "", "Only extract databases for this language")
+}
+
+// cachedDatabases returns the cached databases matching the --nwo and
+// --language flags, newest first.
+func cachedDatabases() []models.CachedDatabase {
+	all, err := utils.ListCachedDatabases()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cachedDatabases []models.CachedDatabase
+	for _, cachedDatabase := range all {
+		if nwoFlag != "" && cachedDatabase.Nwo != nwoFlag {
+			continue
+		}
+		if languageFlag != "" && cachedDatabase.Language != languageFlag {
+			continue
+		}
+		cachedDatabases = append(cachedDatabases, cachedDatabase)
+	}
+	sort.SliceStable(cachedDatabases, func(i, j int) bool {
+		if cachedDatabases[i].Nwo != cachedDatabases[j].Nwo {
+			return cachedDatabases[i].Nwo < cachedDatabases[j].Nwo
+		}
+		if cachedDatabases[i].Language != cachedDatabases[j].Language {
+			return cachedDatabases[i].Language < cachedDatabases[j].Language
+		}
+		return cachedDatabases[i].DownloadedAt.After(cachedDatabases[j].DownloadedAt)
+	})
+	return cachedDatabases
+}
+
+func listDatabases() {
+	cachedDatabases := cachedDatabases()
+	if jsonFlag || utils.JSONOutput() {
+		if err := utils.PrintJSON(cachedDatabases); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(utils.Out(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tLANGUAGE\tCOMMIT\tSIZE\tDOWNLOADED\tEXTRACTED")
+	for _, cachedDatabase := range cachedDatabases {
+		extracted := "no"
+		if cachedDatabase.Extracted != "" {
+			extracted = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d MB\t%s\t%s\n", cachedDatabase.Nwo, cachedDatabase.Language, cachedDatabase.CommitSha, cachedDatabase.Size/(1024*1024), cachedDatabase.DownloadedAt.Format("2006-01-02 15:04"), extracted)
+	}
+	w.Flush()
+}
+
+func pruneDatabases() {
+	seen := make(map[string]bool)
+	count := 0
+	var freed int64
+	for _, cachedDatabase := range cachedDatabases() {
+		key := cachedDatabase.Nwo + "/" + cachedDatabase.Language
+		latest := !seen[key]
+		seen[key] = true
+		expired := olderThanFlag > 0 && time.Since(cachedDatabase.DownloadedAt) > time.Duration(olderThanFlag)*24*time.Hour
+		if latest && !expired && !allFlag {
+			continue
+		}
+		err := utils.RemoveCachedDatabase(cachedDatabase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		utils.Printf("Removed %s (%s) at %s\n", cachedDatabase.Nwo, cachedDatabase.Language, cachedDatabase.CommitSha)
+		utils.EmitEvent(models.Event{Type: utils.DatabaseRemovedEvent, Nwo: cachedDatabase.Nwo, Language: cachedDatabase.Language, Artifact: "database", Files: []string{cachedDatabase.Path}, Data: cachedDatabase})
+		count++
+		freed += cachedDatabase.Size
+	}
+	utils.Printf("%d databases removed, %d MB freed\n", count, freed/(1024*1024))
+}
+
+func extractDatabases() {
+	seen := make(map[string]bool)
+	failed := 0
+	for _, cachedDatabase := range cachedDatabases() {
+		key := cachedDatabase.Nwo + "/" + cachedDatabase.Language
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		dbPath, err := utils.ExtractDatabase(cachedDatabase.Path)
+		if err == nil {
+			err = utils.ResolveDatabase(dbPath)
+		}
+		if err != nil {
+			utils.Printf("Failed to extract %s (%s): %v\n", cachedDatabase.Nwo, cachedDatabase.Language, err)
+			utils.EmitEvent(models.Event{Type: utils.ErrorEvent, Nwo: cachedDatabase.Nwo, Language: cachedDatabase.Language, Artifact: "database", Error: err.Error()})
+			failed++
+			continue
+		}
+		utils.Printf("%s (%s): %s\n", cachedDatabase.Nwo, cachedDatabase.Language, dbPath)
+		utils.EmitEvent(models.Event{Type: utils.DatabaseExtractedEvent, Nwo: cachedDatabase.Nwo, Language: cachedDatabase.Language, Artifact: "database", Files: []string{dbPath}})
+	}
+	if failed > 0 {
+		utils.Fatalf("Failed to extract %d databases", failed)
+	}
+}
+
+type databaseDownload struct {
+	Nwo      string
+	Metadata map[string]interface{}
+	Path     string
+	Err      error
+}
+
+func downloadDatabases() {
+	var repositories []string
+	if nwoFlag != "" {
+		repositories = []string{nwoFlag}
+	} else if listFlag != "" {
+		configData, err := utils.GetConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		listFile := configData.ListFile
+		if listFile == "" {
+			utils.Fatalf("Please specify a list file.")
+		}
+		repositories, err = utils.ResolveRepositories(listFile, listFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		utils.Fatalf("Please specify a list or a repository.")
+	}
+	if outputDirFlag != "" {
+		err := os.MkdirAll(outputDirFlag, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	limits, err := resolveDownloadLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+	layout := utils.ResolveLayout(layoutFlag)
+	if err := utils.ValidateDatabaseLayout(layout); err != nil {
+		log.Fatal(err)
+	}
+
+	// fetch the metadata first to report missing databases and download sizes
+	utils.Printf("Fetching %s database metadata for %d repositories\n", languageFlag, len(repositories))
+	metadataTasks := runDatabaseWorkers(repositories, limits.ArtifactWorkers, func(download *databaseDownload) {
+		download.Metadata, download.Err = utils.GetDatabaseMetadata(download.Nwo, languageFlag)
+	}, nil)
+	var available []string
+	var missing []string
+	metadata := make(map[string]map[string]interface{})
+	var totalSize int64
+	for _, download := range metadataTasks {
+		var httpErr api.HTTPError
+		if errors.As(download.Err, &httpErr) && httpErr.StatusCode == 404 {
+			missing = append(missing, download.Nwo)
+			continue
+		} else if download.Err != nil {
+			utils.Printf("Failed to fetch database metadata for %s: %v\n", download.Nwo, download.Err)
+			continue
+		}
+		size, _ := download.Metadata["size"].(float64)
+		// databases served from the cache are not part of the download size
+		if utils.IsDatabaseCached(download.Nwo, languageFlag, download.Metadata) {
+			utils.Printf("  %s: %d MB (cached)\n", download.Nwo, int64(size)/(1024*1024))
+		} else {
+			totalSize += int64(size)
+			utils.Printf("  %s: %d MB\n", download.Nwo, int64(size)/(1024*1024))
+		}
+		available = append(available, download.Nwo)
+		metadata[download.Nwo] = download.Metadata
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		utils.Printf("%d repositories have no %s database:\n", len(missing), languageFlag)
+		for _, nwo := range missing {
+			utils.Printf("  %s\n", nwo)
+		}
+	}
+	utils.Printf("Downloading %d databases (%d MB)\n", len(available), totalSize/(1024*1024))
+
+	utils.StartProgress("Downloading", len(available), utils.IsInteractive())
+	utils.AddProgressBytes(totalSize)
+	runDatabaseWorkers(available, limits.DatabaseWorkers, func(download *databaseDownload) {
+		cachedDatabase, err := utils.CacheDatabaseWithMetadata(download.Nwo, languageFlag, metadata[download.Nwo])
+		download.Path = cachedDatabase.Path
+		if err == nil && outputDirFlag != "" {
+			task := models.DownloadTask{Nwo: download.Nwo, Artifact: "database", Language: languageFlag, OutputDir: outputDirFlag, Layout: layout}
+			download.Path, err = utils.ArtifactPath(task, utils.DatabaseArtifact)
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(download.Path), 0755)
+			}
+			if err == nil {
+				err = utils.LinkFile(cachedDatabase.Path, download.Path)
+			}
+		}
+		download.Err = err
+	}, func(download databaseDownload) {
+		if download.Err != nil {
+			utils.CompleteProgressTask("Failed to download database for "+download.Nwo, download.Err)
+			utils.EmitEvent(models.Event{Type: utils.ErrorEvent, Nwo: download.Nwo, Language: languageFlag, Artifact: "database", Error: download.Err.Error()})
+		} else {
+			utils.CompleteProgressTask("Downloaded database for "+download.Nwo, nil)
+			utils.EmitEvent(models.Event{Type: utils.DatabaseDownloadedEvent, Nwo: download.Nwo, Language: languageFlag, Artifact: "database", Files: []string{download.Path}})
+		}
+	})
+	utils.StopProgress()
+}
+
+// runDatabaseWorkers runs work for every repository using the given number of
+// workers, calling progress as each repository completes.
+func runDatabaseWorkers(repositories []string, workers int, work func(*databaseDownload), progress func(databaseDownload)) []databaseDownload {
+	wg := new(sync.WaitGroup)
+	taskChannel := make(chan databaseDownload)
+	resultChannel := make(chan databaseDownload, len(repositories))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for download := range taskChannel {
+				work(&download)
+				resultChannel <- download
+			}
+		}()
+	}
+	go func() {
+		for _, nwo := range repositories {
+			taskChannel <- databaseDownload{Nwo: nwo}
+		}
+		close(taskChannel)
+	}()
+	var results []databaseDownload
+	for range repositories {
+		download := <-resultChannel
+		if progress != nil {
+			progress(download)
+		}
+		results = append(results, download)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Nwo < results[j].Nwo
+	})
+	return results
+}
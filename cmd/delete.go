@@ -9,6 +9,7 @@ import (
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 
+	"github.com/GitHubSecurityLab/gh-mrva/models"
 	"github.com/GitHubSecurityLab/gh-mrva/utils"
 	"github.com/spf13/cobra"
 )
@@ -18,7 +19,11 @@ var deleteCmd = &cobra.Command{
 	Short: "Delete a saved session.",
 	Long:  `Delete a saved session.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		deleteSession()
+		if err := deleteSession(); err != nil {
+			utils.Fatalf("%v", err)
+		}
+		utils.Printf("Deleted session %s\n", sessionNameFlag)
+		utils.EmitEvent(models.Event{Type: utils.SessionDeletedEvent, Session: sessionNameFlag})
 	},
 }
 
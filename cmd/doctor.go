@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose problems with the environment.",
+	Long: `Diagnose problems with the environment.
+
+doctor checks the config files, the CodeQL CLI and libraries, the sessions file,
+the repository list file, the authentication to the GitHub host and the scopes
+of the token, and the controller repository. Each check passes, warns or fails,
+with a hint on how to fix it. doctor exits with an error if a check fails.`,
+	// the problems are reported as checks rather than stopping the command
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupConfig(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		doctor()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().BoolVarP(&jsonFlag, "json", "j", false, "Output in JSON format (default: false)")
+}
+
+func doctor() {
+	checks := []models.DoctorCheck{utils.CheckConfigFiles()}
+	// the checks depending on the config options are skipped if it is broken
+	configValid := checks[0].Status != utils.DoctorFail
+	configData := models.Config{}
+	if configValid {
+		if err := utils.SetProfile(utils.ResolveProfile(profileFlag, "")); err != nil {
+			checks = append(checks, models.DoctorCheck{Name: "profile", Status: utils.DoctorFail, Message: err.Error(), Hint: "Select one of the profiles of the config files"})
+		}
+		configData, _ = utils.GetConfig()
+	}
+	utils.SetHost(utils.ResolveHost(hostnameFlag, ""))
+
+	if configValid {
+		checks = append(checks, utils.CheckCodeQLCLI(codeqlCLIFlag))
+		checks = append(checks, utils.CheckCodeQLLibraries())
+	}
+	checks = append(checks, utils.CheckSessionsFile())
+	if configValid {
+		checks = append(checks, utils.CheckListFile(configData.ListFile))
+	}
+	auth := utils.CheckAuth()
+	checks = append(checks, auth)
+	if auth.Status != utils.DoctorFail {
+		client, err := utils.NewRESTClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+		api := utils.CheckAPI(client)
+		checks = append(checks, api)
+		if api.Status != utils.DoctorFail && configValid {
+			checks = append(checks, utils.CheckController(client, configData.Controller)...)
+		}
+	}
+
+	counts := map[string]int{}
+	for _, check := range checks {
+		counts[check.Status]++
+		utils.EmitEvent(models.Event{Type: utils.DoctorCheckEvent, Data: check})
+	}
+	if jsonFlag {
+		if err := utils.PrintJSON(checks); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, check := range checks {
+			utils.Printf("%-4s  %s: %s\n", strings.ToUpper(check.Status), check.Name, check.Message)
+			if check.Hint != "" {
+				utils.Printf("      %s\n", check.Hint)
+			}
+		}
+		utils.Printf("\n%d passed, %d warnings, %d failed\n", counts[utils.DoctorPass], counts[utils.DoctorWarn], counts[utils.DoctorFail])
+	}
+	if counts[utils.DoctorFail] > 0 {
+		utils.EmitEvent(models.Event{Type: utils.ErrorEvent, Error: fmt.Sprintf("%d checks failed", counts[utils.DoctorFail]), Count: counts[utils.DoctorFail]})
+		os.Exit(1)
+	}
+}
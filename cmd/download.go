@@ -11,8 +11,6 @@ import (
 	"github.com/GitHubSecurityLab/gh-mrva/utils"
 	"log"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
 
 	"github.com/spf13/cobra"
@@ -34,6 +32,11 @@ func init() {
 	downloadCmd.Flags().StringVarP(&outputDirFlag, "output-dir", "o", "", "Output directory")
 	downloadCmd.Flags().BoolVarP(&downloadDBsFlag, "download-dbs", "d", false, "Download databases (optional)")
 	downloadCmd.Flags().StringVarP(&nwoFlag, "nwo", "n", "", "Repository to download artifacts for (optional)")
+	downloadCmd.Flags().StringVarP(&suppressionsFileFlag, "suppressions", "", "", "Path to suppressions file (YAML or SARIF baseline, overrides config file)")
+	downloadCmd.Flags().StringVarP(&layoutFlag, "layout", "", "", "Template for the artifact paths relative to the output directory (overrides config file)")
+	downloadCmd.Flags().BoolVarP(&fullArtifactFlag, "full-artifact", "", false, "Keep all files of the artifacts, including logs and metadata (optional)")
+	downloadCmd.Flags().IntVarP(&maxArtifactSizeFlag, "max-artifact-size", "", config.MAX_ARTIFACT_SIZE_MB, "Maximum decompressed size of an artifact in MB")
+	addDownloadLimitFlags(downloadCmd)
 	downloadCmd.MarkFlagRequired("output-dir")
 	downloadCmd.MarkFlagsMutuallyExclusive("session", "run")
 }
@@ -56,21 +59,45 @@ func downloadArtifacts() {
 	if sessionNameFlag != "" {
 		controller, runs, language, err = utils.LoadSession(sessionNameFlag)
 		if err != nil {
-			fmt.Println(err)
+			utils.Fatalf("%v", err)
 		} else if len(runs) == 0 {
-			fmt.Println("No runs found for sessions" + sessionNameFlag)
+			utils.Fatalf("No runs found for session %s", sessionNameFlag)
 		}
 	} else if runIdFlag > 0 {
 		controller, runs, language, err = utils.LoadRun(runIdFlag)
 		if err != nil {
-			fmt.Println(err)
+			utils.Fatalf("%v", err)
 		}
 	} else {
-		fmt.Println("Please specify a session or run to download artifacts for")
-		return
+		utils.Fatalf("Please specify a session or run to download artifacts for")
+	}
+
+	if suppressionsFile := utils.ResolveSuppressionsFile(suppressionsFileFlag); suppressionsFile != "" {
+		suppressions, err := utils.LoadSuppressions(suppressionsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		utils.Printf("Loaded %d suppressions from %s\n", len(suppressions), suppressionsFile)
+		utils.SetSuppressions(suppressions)
+	}
+
+	limits, err := resolveDownloadLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	layout := utils.ResolveLayout(layoutFlag)
+	if err := utils.ValidateLayout(layout); err != nil {
+		log.Fatal(err)
+	}
+	sessionName := sessionNameFlag
+	if sessionName == "" {
+		sessionName = utils.GetRunSessionName(runIdFlag)
 	}
 
 	var downloadTasks []models.DownloadTask
+	var artifactTasks []models.DownloadTask
+	var databaseTasks []models.DownloadTask
 
 	for _, run := range runs {
 		runDetails, err := utils.GetRunDetails(controller, run.Id)
@@ -78,9 +105,11 @@ func downloadArtifacts() {
 			log.Fatal(err)
 		}
 		if runDetails["status"] == "in_progress" {
-			log.Printf("Run %d is not complete yet. Please try again later.", run.Id)
+			utils.Printf("Run %d is not complete yet. Please try again later.\n", run.Id)
+			utils.EmitEvent(models.Event{Type: utils.RunInProgressEvent, Session: sessionNameFlag, RunId: run.Id})
 			return
 		}
+		var queryMetadata map[string]string
 		for _, r := range runDetails["scanned_repositories"].([]interface{}) {
 			repo := r.(map[string]interface{})
 			result_count := repo["result_count"]
@@ -91,75 +120,123 @@ func downloadArtifacts() {
 				continue
 			}
 			if result_count != nil && result_count.(float64) > 0 {
-				outputFilename := fmt.Sprintf("%s_%d", nwo, run.Id)
-				outputFilename = strings.Replace(outputFilename, "/", "_", -1)
-				fmt.Println(fmt.Sprintf("Downloading artifacts for %s", outputFilename))
+				utils.Println(fmt.Sprintf("Downloading artifacts for %s (%d)", nwo, run.Id))
+				if queryMetadata == nil && len(run.Queries) == 0 {
+					// the metadata is optional, so a broken CLI setting falls back to codeql on the PATH
+					if codeqlCLI, err := utils.ResolveCodeQLCLI(codeqlCLIFlag); err == nil {
+						utils.SetCodeQLCLI(codeqlCLI)
+					}
+					queryMetadata = utils.GetRunMetadata(run)
+				}
+				task := models.DownloadTask{
+					RunId:           run.Id,
+					QueryId:         run.QueryId,
+					Nwo:             nwo,
+					Controller:      controller,
+					Artifact:        "artifact",
+					Language:        language,
+					OutputDir:       outputDirFlag,
+					Session:         sessionName,
+					Layout:          layout,
+					ResultCount:     int(result_count.(float64)),
+					FullArtifact:    fullArtifactFlag,
+					MaxArtifactSize: int64(maxArtifactSizeFlag) * 1024 * 1024,
+					QueryMetadata:   queryMetadata,
+					Queries:         run.Queries,
+				}
 
 				// download artifacts if they don't exist
-				sarifPath := filepath.Join(outputDirFlag, fmt.Sprintf("%s.sarif", outputFilename))
-				bqrsPath := filepath.Join(outputDirFlag, fmt.Sprintf("%s.bqrs", outputFilename))
+				bqrsPath, err := utils.ArtifactPath(task, utils.BqrsArtifact)
+				if err != nil {
+					utils.Fatalf("%v", err)
+				}
 				_, bqrsErr := os.Stat(bqrsPath)
-				_, sarifErr := os.Stat(sarifPath)
-				if errors.Is(bqrsErr, os.ErrNotExist) && errors.Is(sarifErr, os.ErrNotExist) {
-					downloadTasks = append(downloadTasks, models.DownloadTask{
-						RunId:          run.Id,
-						QueryId:        run.QueryId,
-						Nwo:            nwo,
-						Controller:     controller,
-						Artifact:       "artifact",
-						Language:       language,
-						OutputDir:      outputDirFlag,
-						OutputFilename: outputFilename,
-					})
+				sarifPaths, err := utils.SarifPaths(task)
+				if err != nil {
+					utils.Fatalf("%v", err)
+				}
+				missingSarif := false
+				for _, sarifPath := range sarifPaths {
+					if _, err := os.Stat(sarifPath); errors.Is(err, os.ErrNotExist) {
+						missingSarif = true
+					}
+				}
+				missingResults := errors.Is(bqrsErr, os.ErrNotExist) && missingSarif
+				if fullArtifactFlag {
+					artifactPath, err := utils.ArtifactPath(task, utils.FullArtifact)
+					if err != nil {
+						utils.Fatalf("%v", err)
+					}
+					if _, err := os.Stat(artifactPath); errors.Is(err, os.ErrNotExist) {
+						missingResults = true
+					}
+				}
+				if missingResults {
+					artifactTasks = append(artifactTasks, task)
 				}
 
 				// download database if requested
-				dbPath := filepath.Join(outputDirFlag, fmt.Sprintf("%s_%s_db.zip", outputFilename, language))
 				if downloadDBsFlag {
+					task.Artifact = "database"
 					// check if the database already exists
+					dbPath, err := utils.ArtifactPath(task, utils.DatabaseArtifact)
+					if err != nil {
+						utils.Fatalf("%v", err)
+					}
 					if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
-						downloadTasks = append(downloadTasks, models.DownloadTask{
-							RunId:          run.Id,
-							QueryId:        run.QueryId,
-							Nwo:            nwo,
-							Controller:     controller,
-							Artifact:       "database",
-							Language:       language,
-							OutputDir:      outputDirFlag,
-							OutputFilename: outputFilename,
-						})
+						databaseTasks = append(databaseTasks, task)
 					}
 				}
 			}
 		}
 	}
 
+	downloadTasks = append(artifactTasks, databaseTasks...)
+	utils.StartProgress("Downloading", len(downloadTasks), utils.IsInteractive())
+
 	wg := new(sync.WaitGroup)
 
-	taskChannel := make(chan models.DownloadTask)
+	// artifacts and databases are downloaded by separate pools so that a few
+	// large databases do not hold back the results
+	artifactChannel := make(chan models.DownloadTask)
+	databaseChannel := make(chan models.DownloadTask)
 	resultChannel := make(chan models.DownloadTask, len(downloadTasks))
 
 	// Start the workers
-	for i := 0; i < config.WORKERS; i++ {
+	for i := 0; i < limits.ArtifactWorkers; i++ {
 		wg.Add(1)
-		go utils.DownloadWorker(wg, taskChannel, resultChannel)
+		go utils.DownloadWorker(wg, artifactChannel, resultChannel)
+	}
+	for i := 0; i < limits.DatabaseWorkers && len(databaseTasks) > 0; i++ {
+		wg.Add(1)
+		go utils.DownloadWorker(wg, databaseChannel, resultChannel)
 	}
 
-	// Send jobs to worker
-	for _, downloadTask := range downloadTasks {
-		taskChannel <- downloadTask
+	// Send jobs to workers
+	go func() {
+		for _, downloadTask := range artifactTasks {
+			artifactChannel <- downloadTask
+		}
+		close(artifactChannel)
+	}()
+	for _, downloadTask := range databaseTasks {
+		databaseChannel <- downloadTask
 	}
-	close(taskChannel)
+	close(databaseChannel)
 
-	count := 0
 	progressDone := make(chan bool)
 
+	var manifestEntries []models.ManifestEntry
 	go func() {
 		for value := range resultChannel {
-			count++
-			fmt.Printf("Downloaded %s for %s (%d/%d)\n", value.Artifact, value.Nwo, count, len(downloadTasks))
+			if value.Err != nil {
+				utils.CompleteProgressTask(fmt.Sprintf("Failed to download %s for %s", value.Artifact, value.Nwo), value.Err)
+			} else {
+				utils.CompleteProgressTask(fmt.Sprintf("Downloaded %s for %s", value.Artifact, value.Nwo), nil)
+			}
+			utils.EmitEvent(downloadEvent(value))
+			manifestEntries = append(manifestEntries, value.Files...)
 		}
-		fmt.Println(fmt.Sprintf("%d artifacts downloaded", count))
 		progressDone <- true
 	}()
 
@@ -171,4 +248,56 @@ func downloadArtifacts() {
 
 	// drain the progress channel
 	<-progressDone
+	utils.StopProgress()
+
+	// record the downloaded files in the output directory manifest
+	if len(manifestEntries) > 0 {
+		err = utils.UpdateManifest(outputDirFlag, manifestEntries)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func addDownloadLimitFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVarP(&artifactWorkersFlag, "artifact-workers", "", 0, fmt.Sprintf("Number of artifacts downloaded in parallel (default %d)", config.ARTIFACT_WORKERS))
+	cmd.Flags().IntVarP(&databaseWorkersFlag, "database-workers", "", 0, fmt.Sprintf("Number of databases downloaded in parallel (default %d)", config.DATABASE_WORKERS))
+	cmd.Flags().StringVarP(&bandwidthLimitFlag, "bandwidth-limit", "", "", "Maximum total download rate per second, e.g. 512K or 10M (default unlimited)")
+	cmd.Flags().IntVarP(&maxConnsPerHostFlag, "max-connections-per-host", "", 0, "Maximum number of connections to each host (default unlimited)")
+}
+
+// resolveDownloadLimits combines the download limit flags with the config file
+// and applies them to all subsequent downloads.
+func resolveDownloadLimits() (models.DownloadLimits, error) {
+	limits, err := utils.ResolveDownloadLimits(artifactWorkersFlag, databaseWorkersFlag, bandwidthLimitFlag, maxConnsPerHostFlag)
+	if err != nil {
+		return limits, err
+	}
+	utils.SetDownloadLimits(limits)
+	return limits, nil
+}
+
+func downloadEvent(task models.DownloadTask) models.Event {
+	event := models.Event{
+		Type:     utils.ArtifactDownloadedEvent,
+		Session:  task.Session,
+		RunId:    task.RunId,
+		QueryId:  task.QueryId,
+		Nwo:      task.Nwo,
+		Language: task.Language,
+		Artifact: task.Artifact,
+		Count:    task.ResultCount,
+	}
+	if task.Artifact == "database" {
+		event.Type = utils.DatabaseDownloadedEvent
+		event.Count = 0
+	}
+	for _, file := range task.Files {
+		event.Files = append(event.Files, file.Path)
+	}
+	if task.Err != nil {
+		event.Type = utils.ErrorEvent
+		event.Error = task.Err.Error()
+	}
+	return event
 }
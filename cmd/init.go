@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var publicFlag bool
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Set up the config file and the controller repository.",
+	Long: `Set up the config file and the controller repository.
+
+init writes the controller, list_file and language options to the user config
+file, creates the controller repository if it does not exist, makes sure it has
+a default branch with a commit and that GitHub Actions is enabled on it, and
+writes a starter repository list file. Options that are not given with flags
+or already configured are asked for when running in a terminal. Every step is
+skipped if it is already done, so init can be run again safely.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initialize()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+	initCmd.Flags().StringVarP(&controllerFlag, "controller", "c", "", "MRVA controller repository (default <user>/mrva-controller)")
+	initCmd.Flags().StringVarP(&listFileFlag, "list-file", "f", "", "Path to repo list file (default repo-lists.json in the config directory)")
+	initCmd.Flags().StringVarP(&languageFlag, "language", "l", "", "Default DB language of submit (optional)")
+	initCmd.Flags().BoolVarP(&publicFlag, "public", "", false, "Create the controller repository as a public repository (default: private)")
+}
+
+func initialize() {
+	// compare the flags with the config as it is, to only write what changes
+	utils.SetConfigOverrides(nil)
+	configData, sources, err := utils.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := utils.NewRESTClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	interactive := utils.IsInteractive() && term.IsTerminal(int(os.Stdin.Fd()))
+	input := bufio.NewReader(os.Stdin)
+
+	controller := controllerFlag
+	if controller == "" {
+		controller = configData.Controller
+	}
+	if controller == "" {
+		login, err := utils.GetAuthenticatedUser(client)
+		if err != nil {
+			log.Fatal(err)
+		}
+		controller = login + "/mrva-controller"
+		if interactive {
+			controller = prompt(input, "Controller repository", controller)
+		}
+	}
+	listFile := listFileFlag
+	if listFile == "" {
+		listFile = configData.ListFile
+	}
+	if listFile == "" {
+		listFile = filepath.Join(filepath.Dir(utils.GetConfigFilePath()), "repo-lists.json")
+		if interactive {
+			listFile = prompt(input, "Repository list file", listFile)
+		}
+	}
+	language := languageFlag
+	if language == "" {
+		language = configData.Language
+	}
+	if language == "" && interactive {
+		language = prompt(input, "Default language (optional)", "")
+	}
+
+	// config file
+	options := [][2]string{{"controller", controller}, {"list_file", listFile}, {"language", language}}
+	for _, option := range options {
+		key, value := option[0], option[1]
+		current, _ := utils.GetConfigValue(configData, key)
+		if value == "" || (value == current && isConfigFileSource(sources[key])) {
+			continue
+		}
+		if err := utils.SetConfigFileValue(utils.GetConfigFilePath(), "", key, value); err != nil {
+			log.Fatal(err)
+		}
+		utils.Printf("Set %s to %s in %s\n", key, value, utils.GetConfigFilePath())
+		utils.EmitEvent(models.Event{Type: utils.ConfigSetEvent, Files: []string{utils.GetConfigFilePath()}, Data: models.ConfigSetting{Key: key, Value: value}})
+	}
+
+	// repository list file
+	if _, err := os.Stat(listFile); err == nil {
+		utils.Printf("Repository list file %s exists\n", listFile)
+		emitSetupStep("list_file", listFile, false)
+	} else if errors.Is(err, os.ErrNotExist) {
+		if err := writeStarterListFile(listFile); err != nil {
+			log.Fatal(err)
+		}
+		utils.Printf("Created repository list file %s, add the repositories to run queries on to its 'starter' list\n", listFile)
+		emitSetupStep("list_file", listFile, true)
+	} else {
+		log.Fatal(err)
+	}
+
+	// controller repository
+	created, err := utils.EnsureControllerRepository(client, controller, !publicFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if created {
+		utils.Printf("Created controller repository %s\n", utils.WebURL(controller))
+	} else {
+		utils.Printf("Controller repository %s exists\n", controller)
+	}
+	emitSetupStep("controller", controller, created)
+	branch, created, err := utils.EnsureDefaultBranch(client, controller)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if created {
+		utils.Printf("Created default branch %s of %s\n", branch, controller)
+	} else {
+		utils.Printf("Default branch %s of %s exists\n", branch, controller)
+	}
+	emitSetupStep("default_branch", branch, created)
+	enabled, err := utils.EnsureActionsEnabled(client, controller)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if enabled {
+		utils.Printf("Enabled GitHub Actions on %s\n", controller)
+	} else {
+		utils.Printf("GitHub Actions is enabled on %s\n", controller)
+	}
+	emitSetupStep("actions", controller, enabled)
+}
+
+// emitSetupStep emits an event for a step of init, reporting whether the step
+// changed anything.
+func emitSetupStep(step string, target string, changed bool) {
+	utils.EmitEvent(models.Event{Type: utils.SetupStepEvent, Data: map[string]interface{}{"step": step, "target": target, "changed": changed}})
+}
+
+// isConfigFileSource reports whether an option is set in one of the config
+// files, rather than taken from a default, the environment or a flag.
+func isConfigFileSource(source string) bool {
+	return source == "user config" || source == "project config"
+}
+
+// prompt asks for a value, returning the default if none is entered.
+func prompt(input *bufio.Reader, label string, defaultValue string) string {
+	if defaultValue != "" {
+		utils.Printf("%s [%s]: ", label, defaultValue)
+	} else {
+		utils.Printf("%s: ", label)
+	}
+	answer, err := input.ReadString('\n')
+	if err != nil && answer == "" {
+		return defaultValue
+	}
+	if answer = strings.TrimSpace(answer); answer != "" {
+		return answer
+	}
+	return defaultValue
+}
+
+func writeStarterListFile(path string) error {
+	content, err := json.MarshalIndent(map[string][]string{"starter": {}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
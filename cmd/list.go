@@ -4,8 +4,6 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
 
 	"github.com/GitHubSecurityLab/gh-mrva/models"
@@ -33,31 +31,29 @@ func listSessions() {
 		log.Fatal(err)
 	}
 	if sessions != nil {
-		if jsonFlag {
+		if jsonFlag || utils.JSONOutput() {
 			sessions_list := make([]models.Session, 0, len(sessions))
 			for _, session := range sessions {
 				sessions_list = append(sessions_list, session)
 			}
-			data, err := json.MarshalIndent(sessions_list, "", "  ")
-			if err != nil {
+			if err := utils.PrintJSON(sessions_list); err != nil {
 				log.Fatal(err)
 			}
-			fmt.Println(string(data))
-			// w := &bytes.Buffer{}
-			// jsonpretty.Format(w, bytes.NewReader(data), "  ", true)
-			// fmt.Println(w.String())
 		} else {
 			for name, entry := range sessions {
-				fmt.Printf("%s (%v)\n", name, entry.Timestamp)
-				fmt.Printf("  Controller: %s\n", entry.Controller)
-				fmt.Printf("  Language: %s\n", entry.Language)
-				fmt.Printf("  List file: %s\n", entry.ListFile)
-				fmt.Printf("  List: %s\n", entry.List)
-				fmt.Printf("  Repository count: %d\n", entry.RepositoryCount)
-				fmt.Println("  Runs:")
+				utils.Printf("%s (%v)\n", name, entry.Timestamp)
+				utils.Printf("  Controller: %s\n", entry.Controller)
+				utils.Printf("  Language: %s\n", entry.Language)
+				utils.Printf("  List file: %s\n", entry.ListFile)
+				utils.Printf("  List: %s\n", entry.List)
+				utils.Printf("  Repository count: %d\n", entry.RepositoryCount)
+				utils.Println("  Runs:")
 				for _, run := range entry.Runs {
-					fmt.Printf("    ID: %d\n", run.Id)
-					fmt.Printf("    Query: %s\n", run.Query)
+					utils.Printf("    ID: %d\n", run.Id)
+					utils.Printf("    Query: %s\n", run.Query)
+					if len(run.Queries) > 0 {
+						utils.Printf("    Bundled queries: %d\n", len(run.Queries))
+					}
 				}
 			}
 		}
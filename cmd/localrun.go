@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dbDirFlag   string
+	workersFlag int
+)
+
+var localRunCmd = &cobra.Command{
+	Use:   "local-run",
+	Short: "Runs a query locally against the databases downloaded for a session.",
+	Long: `Runs a query locally against the databases downloaded for a session.
+
+Each database downloaded with 'download --download-dbs' is extracted and analyzed
+with 'codeql database analyze'. The SARIF files are written using the same names
+as 'download' so they can be compared with the results of the remote run.`,
+	PreRunE: setupCodeQLCLI,
+	Run: func(cmd *cobra.Command, args []string) {
+		localRun()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(localRunCmd)
+	localRunCmd.Flags().StringVarP(&sessionNameFlag, "session", "s", "", "Session whose databases should be analyzed")
+	localRunCmd.Flags().StringVarP(&queryFileFlag, "query", "q", "", "Path to query file")
+	localRunCmd.Flags().StringVarP(&dbDirFlag, "db-dir", "d", "", "Directory containing the downloaded databases")
+	localRunCmd.Flags().StringVarP(&outputDirFlag, "output-dir", "o", "", "Output directory")
+	localRunCmd.Flags().StringVarP(&additionalPacksFlag, "additional-packs", "a", "", "Additional Packs")
+	localRunCmd.Flags().IntVarP(&workersFlag, "workers", "w", 0, fmt.Sprintf("Number of databases analyzed in parallel (default %d)", config.DATABASE_WORKERS))
+	localRunCmd.Flags().StringVarP(&layoutFlag, "layout", "", "", "Template for the artifact paths used by download (overrides config file)")
+	localRunCmd.MarkFlagRequired("session")
+	localRunCmd.MarkFlagRequired("query")
+	localRunCmd.MarkFlagRequired("db-dir")
+	localRunCmd.MarkFlagRequired("output-dir")
+}
+
+// localRunTask analyzes a database once for all the runs of the session that
+// scanned its repository.
+type localRunTask struct {
+	Nwo         string
+	DatabaseZip string
+	Outputs     []localRunOutput
+	Err         error
+}
+
+// localRunOutput is where the results of a database are written for a run.
+type localRunOutput struct {
+	RunId      int
+	QueryId    string
+	OutputPath string
+}
+
+func localRun() {
+	controller, runs, language, err := utils.LoadSession(sessionNameFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(queryFileFlag); err != nil {
+		log.Fatal(err)
+	}
+	queryFile, err := filepath.Abs(queryFileFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(outputDirFlag, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	additionalPacks := additionalPacksFlag
+	if codeqlPath := utils.ResolveCodeQLLibraries(""); codeqlPath != "" {
+		if additionalPacks != "" {
+			additionalPacks = additionalPacks + string(os.PathListSeparator) + codeqlPath
+		} else {
+			additionalPacks = codeqlPath
+		}
+	}
+
+	// use the CodeQL CLI version the session was pinned to, if any
+	sessions, err := utils.GetSessions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pinnedVersion := sessions[sessionNameFlag].CodeQLVersion
+	if pinnedVersion != "" && codeqlCLIFlag == "" {
+		utils.UseCodeQLVersion(pinnedVersion)
+	}
+	if _, err := utils.CheckCodeQLVersion(pinnedVersion); err != nil {
+		log.Fatal(err)
+	}
+
+	layout := utils.ResolveLayout(layoutFlag)
+	if err := utils.ValidateLayout(layout); err != nil {
+		log.Fatal(err)
+	}
+	limits, err := utils.ResolveDownloadLimits(0, workersFlag, "", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tasks []*localRunTask
+	for _, run := range runs {
+		runDetails, err := utils.GetRunDetails(controller, run.Id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range runDetails["scanned_repositories"].([]interface{}) {
+			nwo := r.(map[string]interface{})["repository"].(map[string]interface{})["full_name"].(string)
+			task := models.DownloadTask{
+				RunId:     run.Id,
+				QueryId:   run.QueryId,
+				Nwo:       nwo,
+				Language:  language,
+				OutputDir: dbDirFlag,
+				Session:   sessionNameFlag,
+				Layout:    layout,
+			}
+			dbPath, err := utils.ArtifactPath(task, utils.DatabaseArtifact)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if _, err := os.Stat(dbPath); err != nil {
+				continue
+			}
+			task.OutputDir = outputDirFlag
+			outputPath, err := utils.ArtifactPath(task, utils.SarifArtifact)
+			if err != nil {
+				log.Fatal(err)
+			}
+			output := localRunOutput{RunId: run.Id, QueryId: run.QueryId, OutputPath: outputPath}
+			// the runs of a session share the databases of their repositories
+			if task := findLocalRunTask(tasks, dbPath); task != nil {
+				task.Outputs = append(task.Outputs, output)
+				continue
+			}
+			tasks = append(tasks, &localRunTask{Nwo: nwo, DatabaseZip: dbPath, Outputs: []localRunOutput{output}})
+		}
+	}
+	if len(tasks) == 0 {
+		utils.Fatalf("No databases found for session %s in %s. Use 'download --download-dbs' to download them.", sessionNameFlag, dbDirFlag)
+	}
+	utils.Printf("Analyzing %d databases with %s\n", len(tasks), queryFile)
+
+	wg := new(sync.WaitGroup)
+	taskChannel := make(chan *localRunTask)
+	resultChannel := make(chan *localRunTask, len(tasks))
+
+	for i := 0; i < limits.DatabaseWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range taskChannel {
+				task.Err = analyzeLocalRunTask(task, queryFile, additionalPacks)
+				resultChannel <- task
+			}
+		}()
+	}
+
+	go func() {
+		for _, task := range tasks {
+			taskChannel <- task
+		}
+		close(taskChannel)
+	}()
+
+	count := 0
+	failed := 0
+	for i := 0; i < len(tasks); i++ {
+		task := <-resultChannel
+		count++
+		if task.Err != nil {
+			failed++
+			utils.Printf("Failed to analyze %s (%d/%d): %v\n", filepath.Base(task.DatabaseZip), count, len(tasks), task.Err)
+		} else {
+			utils.Printf("Analyzed %s (%d/%d)\n", filepath.Base(task.DatabaseZip), count, len(tasks))
+		}
+		for _, output := range task.Outputs {
+			if task.Err != nil {
+				utils.EmitEvent(models.Event{Type: utils.ErrorEvent, Session: sessionNameFlag, RunId: output.RunId, QueryId: output.QueryId, Nwo: task.Nwo, Language: language, Error: task.Err.Error()})
+			} else {
+				utils.EmitEvent(models.Event{Type: utils.DatabaseAnalyzedEvent, Session: sessionNameFlag, RunId: output.RunId, QueryId: output.QueryId, Nwo: task.Nwo, Language: language, Files: []string{output.OutputPath}})
+			}
+		}
+	}
+	wg.Wait()
+	utils.Printf("%d databases analyzed, %d failed\n", count-failed, failed)
+}
+
+// findLocalRunTask returns the task analyzing the database at dbPath, which may
+// be another link to the same cached database.
+func findLocalRunTask(tasks []*localRunTask, dbPath string) *localRunTask {
+	info, err := os.Stat(dbPath)
+	for _, task := range tasks {
+		if task.DatabaseZip == dbPath {
+			return task
+		}
+		if err != nil {
+			continue
+		}
+		if taskInfo, err := os.Stat(task.DatabaseZip); err == nil && os.SameFile(info, taskInfo) {
+			return task
+		}
+	}
+	return nil
+}
+
+// analyzeLocalRunTask analyzes a database once and writes the results to the
+// output path of every run.
+func analyzeLocalRunTask(task *localRunTask, queryFile string, additionalPacks string) error {
+	dbPath, err := utils.ExtractDatabase(task.DatabaseZip)
+	if err != nil {
+		return err
+	}
+	firstOutput := task.Outputs[0].OutputPath
+	err = os.MkdirAll(filepath.Dir(firstOutput), 0755)
+	if err != nil {
+		return err
+	}
+	err = utils.AnalyzeDatabase(dbPath, queryFile, additionalPacks, firstOutput)
+	if err != nil {
+		return err
+	}
+	for _, output := range task.Outputs[1:] {
+		if output.OutputPath == firstOutput {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(output.OutputPath), 0755)
+		if err != nil {
+			return err
+		}
+		err = utils.CopyFile(firstOutput, output.OutputPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -28,6 +28,7 @@ import (
 	"path/filepath"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -47,18 +48,138 @@ var (
 	querySuiteFileFlag  string
 	additionalPacksFlag string
 	actionBranchFlag 	string
+	suppressionsFileFlag string
+	reposFlag           bool
+	stateFlag           string
+	sortFlag            string
+	minResultsFlag      int
+	queryIdFlag         string
+	formatFlag          string
+	templateFlag        string
+	layoutFlag          string
+	fullArtifactFlag    bool
+	maxArtifactSizeFlag int
+	artifactWorkersFlag int
+	databaseWorkersFlag int
+	bandwidthLimitFlag  string
+	maxConnsPerHostFlag int
+	outputFormatFlag    string
+	logLevelFlag        string
+	logFileFlag         string
+	debugHTTPFlag       bool
+	codeqlCLIFlag       string
+	codeqlVersionFlag   string
+	profileFlag         string
+	hostnameFlag        string
+	// closes the --log-file once the command is done
+	closeLog = func() error { return nil }
 )
+
+// flags overriding a config option, by config key
+var configFlags = map[string]string{
+	"controller":               "controller",
+	"list-file":                "list_file",
+	"codeql-path":              "codeql_path",
+	"codeql-cli":               "codeql_cli",
+	"hostname":                 "host",
+	"language":                 "language",
+	"action-branch":            "action_branch",
+	"suppressions":             "suppressions_file",
+	"layout":                   "layout",
+	"artifact-workers":         "artifact_workers",
+	"database-workers":         "database_workers",
+	"bandwidth-limit":          "bandwidth_limit",
+	"max-connections-per-host": "max_connections_per_host",
+}
 var rootCmd = &cobra.Command{
 	Use:   "gh-mrva",
 	Short: "Run CodeQL queries at scale using GitHub's Multi-Repository Variant Analysis (MRVA)",
 	Long:  `Run CodeQL queries at scale using GitHub's Multi-Repository Variant Analysis (MRVA)`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupConfig(cmd); err != nil {
+			return err
+		}
+		// commands working on an existing session use the profile it was submitted with
+		sessionName := sessionNameFlag
+		if sessionName == "" && runIdFlag > 0 {
+			sessionName = utils.GetRunSessionName(runIdFlag)
+		}
+		if err := useSession(sessionName); err != nil {
+			return err
+		}
+		// report a broken config before the command starts working
+		if _, err := utils.GetConfig(); err != nil {
+			return err
+		}
+		return nil
+	},
+}
+
+// setupCodeQLCLI selects the CodeQL CLI. It only runs before the commands that
+// run codeql, so that a stale CLI setting does not break the other commands.
+func setupCodeQLCLI(cmd *cobra.Command, args []string) error {
+	codeqlCLI, err := utils.ResolveCodeQLCLI(codeqlCLIFlag)
+	if err != nil {
+		return err
+	}
+	utils.SetCodeQLCLI(codeqlCLI)
+	return nil
+}
+
+// useSession selects the profile and the host a session was submitted with, so
+// that commands working on several sessions poll and download each with its
+// own settings.
+func useSession(sessionName string) error {
+	if err := utils.SetProfile(utils.ResolveProfile(profileFlag, sessionName)); err != nil {
+		return err
+	}
+	utils.SetHost(utils.ResolveHost(hostnameFlag, sessionName))
+	return nil
+}
+
+// setupOutput applies the global output and logging flags.
+func setupOutput() error {
+	if err := utils.SetOutputFormat(outputFormatFlag); err != nil {
+		return err
+	}
+	var err error
+	closeLog, err = utils.SetupLogging(logLevelFlag, logFileFlag, debugHTTPFlag)
+	return err
+}
+
+// setupConfig applies the global output and logging flags and passes the flags
+// overriding config options to the config loader.
+func setupConfig(cmd *cobra.Command) error {
+	// the flags and arguments are valid at this point, the usage would not
+	// help with the errors that follow
+	cmd.SilenceUsage = true
+	if err := setupOutput(); err != nil {
+		return err
+	}
+	overrides := map[string]string{}
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		if key, ok := configFlags[flag.Name]; ok {
+			overrides[key] = flag.Value.String()
+		}
+	})
+	utils.SetConfigOverrides(overrides)
+	return nil
 }
 
 func Execute() {
+	if err := execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func execute() error {
+	// closeLog is only set once the command starts running
+	defer func() { closeLog() }()
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		utils.EmitError(err)
 	}
+	return err
 }
 
 func init() {
@@ -87,4 +208,15 @@ func init() {
 		sessionsFile.Close()
 	}
 	utils.SetSessionsFilePath(sessionsFilePath)
+	utils.SetTriageFilePath(filepath.Join(configPath, "gh-mrva", "triage.yml"))
+	utils.SetDatabaseCacheDir(filepath.Join(configPath, "gh-mrva", "databases"))
+	utils.SetCodeQLDistributionsDir(filepath.Join(configPath, "gh-mrva", "codeql"))
+
+	rootCmd.PersistentFlags().StringVarP(&outputFormatFlag, "output", "", "text", "Output format: text or json-lines (one JSON event per line on stdout)")
+	rootCmd.PersistentFlags().StringVarP(&logLevelFlag, "log-level", "", "warn", "Log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVarP(&logFileFlag, "log-file", "", "", "Write the log to this file instead of stderr")
+	rootCmd.PersistentFlags().StringVarP(&hostnameFlag, "hostname", "", "", "GitHub host to use, e.g. a GitHub Enterprise Server instance (overrides config file and GH_HOST)")
+	rootCmd.PersistentFlags().StringVarP(&profileFlag, "profile", "", "", "Configuration profile to use (overrides GH_MRVA_PROFILE)")
+	rootCmd.PersistentFlags().StringVarP(&codeqlCLIFlag, "codeql-cli", "", "", "Path to the CodeQL CLI binary or distribution (overrides config file)")
+	rootCmd.PersistentFlags().BoolVarP(&debugHTTPFlag, "debug-http", "", false, "Log the API requests and responses, with credentials redacted (implies --log-level debug)")
 }
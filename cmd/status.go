@@ -4,9 +4,14 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"encoding/json"
+	"encoding/csv"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
 
 	"github.com/GitHubSecurityLab/gh-mrva/models"
 	"github.com/GitHubSecurityLab/gh-mrva/utils"
@@ -27,6 +32,15 @@ func init() {
 	statusCmd.Flags().StringVarP(&sessionNameFlag, "session", "s", "", "Selects the named session")
 	statusCmd.Flags().StringVarP(&sessionPrefixFlag, "prefix", "p", "", "Select all sessions starting with a given prefix")
 	statusCmd.Flags().BoolVarP(&jsonFlag, "json", "j", false, "Output in JSON format (default: false)")
+	statusCmd.Flags().BoolVarP(&reposFlag, "repos", "r", false, "List the status of each repository")
+	statusCmd.Flags().StringVarP(&stateFlag, "state", "", "", "Only list repositories in the given state: failed, skipped, succeeded or no-results (implies --repos)")
+	statusCmd.Flags().StringVarP(&sortFlag, "sort", "", "", "Sort repositories by count, stars or nwo")
+	statusCmd.Flags().IntVarP(&minResultsFlag, "min-results", "", 0, "Only list repositories with at least this many results")
+	statusCmd.Flags().StringVarP(&queryIdFlag, "query-id", "", "", "Only include runs of the given query id")
+	statusCmd.Flags().StringVarP(&formatFlag, "format", "", "table", "Output format: table, json, csv, markdown or template")
+	statusCmd.Flags().StringVarP(&templateFlag, "template", "t", "", "Go text/template used with --format template")
+	statusCmd.Flags().StringVarP(&suppressionsFileFlag, "suppressions", "", "", "Path to suppressions file (YAML or SARIF baseline, overrides config file)")
+	statusCmd.Flags().StringVarP(&outputDirFlag, "output-dir", "o", "", "Directory the results were downloaded to, whose suppressed results are left out of the totals")
 }
 
 func sessionStatus() {
@@ -42,30 +56,77 @@ func sessionStatus() {
 			log.Fatal(err)
 		}
 	} else {
-		fmt.Println("Please specify a session name or prefix")
-		return
+		utils.Fatalf("Please specify a session name or prefix")
+	}
+
+	switch stateFlag {
+	case "", "failed", "skipped", "succeeded", "no-results":
+	default:
+		utils.Fatalf("Invalid state '%s'. Valid states are failed, skipped, succeeded and no-results", stateFlag)
+	}
+	if stateFlag != "" {
+		reposFlag = true
+	}
+	switch sortFlag {
+	case "", "count", "stars", "nwo":
+	default:
+		utils.Fatalf("Invalid sort key '%s'. Valid keys are count, stars and nwo", sortFlag)
+	}
+	switch formatFlag {
+	case "table", "json", "csv", "markdown":
+	case "template":
+		if templateFlag == "" {
+			utils.Fatalf("Please specify a template with --template")
+		}
+	default:
+		utils.Fatalf("Invalid format '%s'. Valid formats are table, json, csv, markdown and template", formatFlag)
+	}
+
+	var suppressions []models.Suppression
+	if suppressionsFile := utils.ResolveSuppressionsFile(suppressionsFileFlag); suppressionsFile != "" {
+		suppressions, err = utils.LoadSuppressions(suppressionsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the results suppressed by download are only counted for an explicit
+	// output directory, any other manifest may belong to other sessions
+	var manifest models.Manifest
+	if outputDirFlag != "" {
+		manifest, err = utils.ReadManifest(outputDirFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	limits, err := utils.ResolveDownloadLimits(0, 0, "", 0)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	var sessionResults []models.Results
 
 	for _, session := range sessions {
+		if err := useSession(session); err != nil {
+			log.Fatal(err)
+		}
 		controller, runs, _, err := utils.LoadSession(session)
 		if err != nil {
-			fmt.Printf("Error loading session %s\n", session)
-			log.Fatal(err)
+			utils.Fatalf("Error loading session %s: %v", session, err)
 		}
 		if len(runs) == 0 {
-			fmt.Printf("No runs found for run name %s\n", session)
+			utils.Printf("No runs found for run name %s\n", session)
 			continue
 		}
 
 		var results models.Results
+		results.Name = session
 
 		global_status := "succeeded"
 
 		for _, run := range runs {
-			if err != nil {
-				log.Fatal(err)
+			if queryIdFlag != "" && !runHasQueryId(run, queryIdFlag) {
+				continue
 			}
 			runDetails, err := utils.GetRunDetails(controller, run.Id)
 			if err != nil {
@@ -125,35 +186,232 @@ func sessionStatus() {
 			results.TotalSkippedNoDatabaseRepositories += int(no_codeql_db_repos["repository_count"].(float64))
 			results.TotalSkippedOverLimitRepositories += int(over_limit_repos["repository_count"].(float64))
 			results.TotalSkippedRepositories += int(total_skipped_repos)
+
+			if reposFlag {
+				for _, repoStatus := range utils.GetRepositoryStatuses(run, runDetails) {
+					if repoStateMatches(repoStatus.State, stateFlag) {
+						results.Repositories = append(results.Repositories, repoStatus)
+					}
+				}
+			}
+		}
+		if reposFlag {
+			utils.FillDatabaseCommitShas(controller, results.Repositories, limits.DatabaseWorkers)
 		}
 		results.Status = global_status
+		utils.SuppressFindings(&results, suppressions)
+		utils.SuppressDownloadedFindings(&results, manifest, runs)
+		filterAndSortFindings(&results)
+		utils.EmitEvent(models.Event{Type: utils.StatusPolledEvent, Session: results.Name, Data: results})
 		sessionResults = append(sessionResults, results)
 	}
 
 	if jsonFlag {
-		data, err := json.MarshalIndent(sessionResults, "", "  ")
-		if err != nil {
-			log.Fatal(err)
+		formatFlag = "json"
+	}
+	switch formatFlag {
+	case "json":
+		err = utils.PrintJSON(sessionResults)
+	case "csv":
+		err = printStatusCSV(sessionResults)
+	case "markdown":
+		printStatusMarkdown(sessionResults)
+	case "template":
+		err = printStatusTemplate(sessionResults)
+	default:
+		printStatusTable(sessionResults, len(suppressions) > 0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// filterAndSortFindings drops repositories below the minimum result count and
+// orders the remaining ones by the requested key. The findings totals are
+// recomputed so that they match the listed repositories.
+func filterAndSortFindings(results *models.Results) {
+	var repos []models.RepoWithFindings
+	results.TotalFindingsCount = 0
+	results.TotalRepositoriesWithFindings = 0
+	for _, repo := range results.ResositoriesWithFindings {
+		if repo.Count >= minResultsFlag {
+			repos = append(repos, repo)
+			results.TotalFindingsCount += repo.Count
+			results.TotalRepositoriesWithFindings += 1
+		}
+	}
+	results.ResositoriesWithFindings = repos
+	sortReposWithFindings(results.ResositoriesWithFindings)
+	sortReposWithFindings(results.SuppressedRepositories)
+
+	var statuses []models.RepoStatus
+	for _, repo := range results.Repositories {
+		if repo.ResultCount >= minResultsFlag {
+			statuses = append(statuses, repo)
+		}
+	}
+	results.Repositories = statuses
+	sort.SliceStable(results.Repositories, func(i, j int) bool {
+		switch sortFlag {
+		case "nwo":
+			return results.Repositories[i].Nwo < results.Repositories[j].Nwo
+		case "stars":
+			return results.Repositories[i].Stars > results.Repositories[j].Stars
+		case "count":
+			return results.Repositories[i].ResultCount > results.Repositories[j].ResultCount
+		}
+		return false
+	})
+}
+
+func sortReposWithFindings(repos []models.RepoWithFindings) {
+	sort.SliceStable(repos, func(i, j int) bool {
+		switch sortFlag {
+		case "nwo":
+			return repos[i].Nwo < repos[j].Nwo
+		case "stars":
+			return repos[i].Stars > repos[j].Stars
+		case "count":
+			return repos[i].Count > repos[j].Count
+		}
+		return false
+	})
+}
+
+// repoStateMatches reports whether a repository state matches the --state
+// filter. Timed out and canceled analyses keep their state but are listed as
+// failed.
+func repoStateMatches(state string, filter string) bool {
+	if filter == "failed" && (state == "timed_out" || state == "canceled") {
+		return true
+	}
+	return filter == "" || filter == state
+}
+
+func printStatusTable(sessionResults []models.Results, showSuppressed bool) {
+	for _, results := range sessionResults {
+		utils.Println("Run name:", results.Name)
+		utils.Println("Status:", results.Status)
+		utils.Println("Total runs:", len(results.Runs))
+		utils.Println("Total successful scans:", results.TotalSuccessfulScans)
+		utils.Println("Total failed scans:", results.TotalFailedScans)
+		utils.Println("Total skipped repositories:", results.TotalSkippedRepositories)
+		utils.Println("Total skipped repositories due to access mismatch:", results.TotalSkippedAccessMismatchRepositories)
+		utils.Println("Total skipped repositories due to not found:", results.TotalSkippedNotFoundRepositories)
+		utils.Println("Total skipped repositories due to no database:", results.TotalSkippedNoDatabaseRepositories)
+		utils.Println("Total skipped repositories due to over limit:", results.TotalSkippedOverLimitRepositories)
+		utils.Println("Total repositories with findings:", results.TotalRepositoriesWithFindings)
+		utils.Println("Total findings:", results.TotalFindingsCount)
+		if showSuppressed {
+			utils.Println("Total suppressed repositories:", results.TotalSuppressedRepositories)
+			utils.Println("Total suppressed findings:", results.TotalSuppressedFindingsCount)
+		}
+		utils.Println("Repositories with findings:")
+		w := tabwriter.NewWriter(utils.Out(), 0, 0, 2, ' ', 0)
+		for _, repo := range results.ResositoriesWithFindings {
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%d stars\n", repo.Nwo, repo.QueryId, repo.Count, repo.Stars)
+		}
+		w.Flush()
+		if reposFlag {
+			utils.Println("Repositories:")
+			for _, repo := range results.Repositories {
+				utils.Printf("  %s (%s): %s\n", repo.Nwo, repo.QueryId, repo.State)
+				if repo.SkipReason != "" {
+					utils.Printf("    Skip reason: %s\n", repo.SkipReason)
+				}
+				if repo.FailureMessage != "" {
+					utils.Printf("    Failure message: %s\n", repo.FailureMessage)
+				}
+				if repo.State != "skipped" {
+					utils.Printf("    Result count: %d\n", repo.ResultCount)
+					utils.Printf("    Artifact size: %d bytes\n", repo.ArtifactSize)
+				}
+				if repo.DatabaseCommitSha != "" {
+					utils.Printf("    Database commit SHA: %s\n", repo.DatabaseCommitSha)
+				}
+			}
+		}
+		if len(results.SuppressedRepositories) > 0 {
+			utils.Println("Suppressed repositories:")
+			for _, repo := range results.SuppressedRepositories {
+				utils.Printf("  %s (%s): %d\n", repo.Nwo, repo.QueryId, repo.Count)
+			}
+		}
+	}
+}
+
+func printStatusCSV(sessionResults []models.Results) error {
+	w := csv.NewWriter(utils.Out())
+	if reposFlag {
+		w.Write([]string{"session", "run_id", "query_id", "nwo", "state", "result_count", "artifact_size_in_bytes", "database_commit_sha", "skip_reason", "failure_message"})
+		for _, results := range sessionResults {
+			for _, repo := range results.Repositories {
+				w.Write([]string{results.Name, strconv.Itoa(repo.RunId), repo.QueryId, repo.Nwo, repo.State, strconv.Itoa(repo.ResultCount), strconv.Itoa(repo.ArtifactSize), repo.DatabaseCommitSha, repo.SkipReason, repo.FailureMessage})
+			}
 		}
-		fmt.Println(string(data))
 	} else {
+		w.Write([]string{"session", "run_id", "query", "query_id", "nwo", "count", "stars"})
 		for _, results := range sessionResults {
-			fmt.Println("Run name:", sessionNameFlag)
-			fmt.Println("Status:", results.Status)
-			fmt.Println("Total runs:", len(results.Runs))
-			fmt.Println("Total successful scans:", results.TotalSuccessfulScans)
-			fmt.Println("Total failed scans:", results.TotalFailedScans)
-			fmt.Println("Total skipped repositories:", results.TotalSkippedRepositories)
-			fmt.Println("Total skipped repositories due to access mismatch:", results.TotalSkippedAccessMismatchRepositories)
-			fmt.Println("Total skipped repositories due to not found:", results.TotalSkippedNotFoundRepositories)
-			fmt.Println("Total skipped repositories due to no database:", results.TotalSkippedNoDatabaseRepositories)
-			fmt.Println("Total skipped repositories due to over limit:", results.TotalSkippedOverLimitRepositories)
-			fmt.Println("Total repositories with findings:", results.TotalRepositoriesWithFindings)
-			fmt.Println("Total findings:", results.TotalFindingsCount)
-			fmt.Println("Repositories with findings:")
 			for _, repo := range results.ResositoriesWithFindings {
-				fmt.Printf("  %s (%s): %d\n", repo.Nwo, repo.QueryId, repo.Count)
+				w.Write([]string{results.Name, strconv.Itoa(repo.RunId), repo.Query, repo.QueryId, repo.Nwo, strconv.Itoa(repo.Count), strconv.Itoa(repo.Stars)})
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func printStatusMarkdown(sessionResults []models.Results) {
+	for _, results := range sessionResults {
+		utils.Printf("## %s\n\n", results.Name)
+		utils.Println("| Status | Runs | Successful scans | Failed scans | Skipped repositories | Repositories with findings | Findings |")
+		utils.Println("| --- | --- | --- | --- | --- | --- | --- |")
+		utils.Printf("| %s | %d | %d | %d | %d | %d | %d |\n\n", results.Status, len(results.Runs), results.TotalSuccessfulScans, results.TotalFailedScans, results.TotalSkippedRepositories, results.TotalRepositoriesWithFindings, results.TotalFindingsCount)
+		if reposFlag {
+			utils.Println("| Repository | Query | State | Results | Artifact size | Database commit | Reason |")
+			utils.Println("| --- | --- | --- | --- | --- | --- | --- |")
+			for _, repo := range results.Repositories {
+				reason := repo.SkipReason
+				if repo.FailureMessage != "" {
+					reason = strings.ReplaceAll(repo.FailureMessage, "\n", " ")
+				}
+				utils.Printf("| %s | %s | %s | %d | %d | %s | %s |\n", repo.Nwo, repo.QueryId, repo.State, repo.ResultCount, repo.ArtifactSize, repo.DatabaseCommitSha, reason)
+			}
+		} else {
+			utils.Println("| Repository | Query | Results | Stars |")
+			utils.Println("| --- | --- | --- | --- |")
+			for _, repo := range results.ResositoriesWithFindings {
+				utils.Printf("| [%s](%s) | %s | %d | %d |\n", repo.Nwo, utils.WebURL(repo.Nwo), repo.QueryId, repo.Count, repo.Stars)
 			}
 		}
+		utils.Println()
+	}
+}
+
+func printStatusTemplate(sessionResults []models.Results) error {
+	t, err := template.New("status").Parse(templateFlag)
+	if err != nil {
+		return err
+	}
+	for _, results := range sessionResults {
+		err = t.Execute(utils.Out(), results)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHasQueryId reports whether a run includes the query with the given id,
+// either as its only query or as one of the queries bundled in it.
+func runHasQueryId(run models.Run, queryId string) bool {
+	if run.QueryId == queryId {
+		return true
+	}
+	for _, query := range run.Queries {
+		if query.QueryId == queryId {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// writeSessions points the sessions and config files to a temporary directory
+// holding the given sessions and config.
+func writeSessions(t *testing.T, sessions map[string]models.Session, config string) {
+	t.Helper()
+	dir := t.TempDir()
+	content, err := yaml.Marshal(sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionsFile := filepath.Join(dir, "sessions.yml")
+	if err := os.WriteFile(sessionsFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sessionsFilePath, configFilePath := utils.GetSessionsFilePath(), utils.GetConfigFilePath()
+	utils.SetSessionsFilePath(sessionsFile)
+	utils.SetConfigFilePath(configFile)
+	t.Cleanup(func() {
+		utils.SetSessionsFilePath(sessionsFilePath)
+		utils.SetConfigFilePath(configFilePath)
+		utils.SetHost("")
+		utils.SetProfile("")
+	})
+}
+
+func TestUseSessionWithMixedPrefix(t *testing.T) {
+	t.Setenv("GH_HOST", "github.com")
+	writeSessions(t, map[string]models.Session{
+		"scan-dotcom": {Name: "scan-dotcom", Controller: "octo/controller"},
+		"scan-ghes":   {Name: "scan-ghes", Controller: "corp/controller", Host: "ghes.example.com"},
+		"scan-local":  {Name: "scan-local", Controller: "octo/controller"},
+	}, "")
+	sessions, err := utils.GetSessionsStartingWith("scan-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"scan-dotcom": "github.com",
+		"scan-ghes":   "ghes.example.com",
+		"scan-local":  "github.com",
+	}
+	if len(sessions) != len(want) {
+		t.Fatalf("GetSessionsStartingWith returned %v", sessions)
+	}
+	for _, session := range sessions {
+		if err := useSession(session); err != nil {
+			t.Fatal(err)
+		}
+		if host := utils.GetHost(); host != want[session] {
+			t.Errorf("session %s: host %s, want %s", session, host, want[session])
+		}
+	}
+}
+
+func TestUseSessionWithRecordedProfile(t *testing.T) {
+	// the profile of the environment only applies to new sessions
+	t.Setenv("GH_MRVA_PROFILE", "work")
+	writeSessions(t, map[string]models.Session{
+		"old-default": {Name: "old-default", Controller: "octo/controller"},
+		"old-corp":    {Name: "old-corp", Controller: "corp/controller", Profile: "corp"},
+	}, "controller: octo/controller\nprofiles:\n  corp:\n    controller: corp/controller\n  work:\n    controller: work/controller\n")
+	tests := []struct {
+		session     string
+		profileFlag string
+		want        string
+	}{
+		{"old-default", "", ""},
+		{"old-corp", "", "corp"},
+		{"new", "", "work"},
+		{"old-corp", "work", "work"},
+	}
+	for _, tt := range tests {
+		profileFlag = tt.profileFlag
+		if err := useSession(tt.session); err != nil {
+			t.Fatal(err)
+		}
+		if profile := utils.GetProfile(); profile != tt.want {
+			t.Errorf("session %s with --profile %q: profile %q, want %q", tt.session, tt.profileFlag, profile, tt.want)
+		}
+	}
+	profileFlag = ""
+}
+
+func TestRepoStateMatches(t *testing.T) {
+	tests := []struct {
+		state  string
+		filter string
+		want   bool
+	}{
+		{"failed", "", true},
+		{"timed_out", "", true},
+		{"failed", "failed", true},
+		{"timed_out", "failed", true},
+		{"canceled", "failed", true},
+		{"timed_out", "succeeded", false},
+		{"skipped", "failed", false},
+		{"succeeded", "succeeded", true},
+	}
+	for _, tt := range tests {
+		if got := repoStateMatches(tt.state, tt.filter); got != tt.want {
+			t.Errorf("repoStateMatches(%q, %q) = %v, want %v", tt.state, tt.filter, got, tt.want)
+		}
+	}
+}
@@ -4,9 +4,10 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/GitHubSecurityLab/gh-mrva/config"
 	"github.com/GitHubSecurityLab/gh-mrva/models"
@@ -25,11 +26,15 @@ var (
 	queryFile       string
 	querySuiteFile  string
 	actionBranch    string
+	packFlag        string
+	bundleSuiteFlag bool
+	modelPackFlag   []string
 )
 var submitCmd = &cobra.Command{
 	Use:   "submit",
 	Short: "Submit a query or query suite to a MRVA controller.",
 	Long:  `Submit a query or query suite to a MRVA controller.`,
+	PreRunE: setupCodeQLCLI,
 	Run: func(cmd *cobra.Command, args []string) {
 		submitQuery()
 	},
@@ -38,18 +43,21 @@ var submitCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(submitCmd)
 	submitCmd.Flags().StringVarP(&sessionNameFlag, "session", "s", "", "Session name")
-	submitCmd.Flags().StringVarP(&languageFlag, "language", "l", "", "DB language")
+	submitCmd.Flags().StringVarP(&languageFlag, "language", "l", "", "DB language (overrides config file)")
 	submitCmd.Flags().StringVarP(&queryFileFlag, "query", "q", "", "Path to query file")
 	submitCmd.Flags().StringVarP(&querySuiteFileFlag, "query-suite", "x", "", "Path to query suite file")
+	submitCmd.Flags().StringVarP(&packFlag, "pack", "", "", "Query pack from the CodeQL package registry, as scope/name[@version][:path to a query or suite]")
 	submitCmd.Flags().StringVarP(&controllerFlag, "controller", "c", "", "MRVA controller repository (overrides config file)")
 	submitCmd.Flags().StringVarP(&listFileFlag, "list-file", "f", "", "Path to repo list file (overrides config file)")
 	submitCmd.Flags().StringVarP(&listFlag, "list", "i", "", "Name of repo list")
-	submitCmd.Flags().StringVarP(&codeqlPathFlag, "codeql-path", "p", "", "Path to CodeQL distribution (overrides config file)")
+	submitCmd.Flags().StringVarP(&codeqlPathFlag, "codeql-path", "p", "", "Path to a checkout of the CodeQL libraries (overrides config file)")
+	submitCmd.Flags().StringVarP(&codeqlVersionFlag, "codeql-version", "", "", "Pin the CodeQL CLI version used by the session (optional)")
 	submitCmd.Flags().StringVarP(&additionalPacksFlag, "additional-packs", "a", "", "Additional Packs")
-	submitCmd.Flags().StringVarP(&actionBranchFlag, "action-branch", "b", "main", "github/codeql-variant-analysis-action branch to use")
+	submitCmd.Flags().StringVarP(&actionBranchFlag, "action-branch", "b", "", "github/codeql-variant-analysis-action branch to use (overrides config file, default main)")
+	submitCmd.Flags().BoolVarP(&bundleSuiteFlag, "bundle-suite", "", false, "Bundle all the queries of the suite or pack in a single query pack, submitted once per chunk of repositories")
+	submitCmd.Flags().StringArrayVarP(&modelPackFlag, "model-pack", "", nil, "Model pack whose data extensions are applied to the queries, as the path of a pack or scope/name[@version] (can be repeated)")
 	submitCmd.MarkFlagRequired("session")
-	submitCmd.MarkFlagRequired("language")
-	submitCmd.MarkFlagsMutuallyExclusive("query", "query-suite")
+	submitCmd.MarkFlagsMutuallyExclusive("query", "query-suite", "pack")
 }
 
 func submitQuery() {
@@ -58,27 +66,15 @@ func submitQuery() {
 		log.Fatal(err)
 	}
 
-	if controllerFlag != "" {
-		controller = controllerFlag
-	} else if configData.Controller != "" {
-		controller = configData.Controller
-	}
-	if listFileFlag != "" {
-		listFile = listFileFlag
-	} else if configData.ListFile != "" {
-		listFile = configData.ListFile
-	}
-	if codeqlPathFlag != "" {
-		codeqlPath = codeqlPathFlag
-	} else if configData.CodeQLPath != "" {
-		codeqlPath = configData.CodeQLPath
-	}
+	// the flags are applied by the config loader
+	controller = configData.Controller
+	listFile = configData.ListFile
+	language = configData.Language
+	actionBranch = configData.ActionBranch
+	codeqlPath = utils.ResolveCodeQLLibraries(codeqlPathFlag)
 	if additionalPacksFlag != "" {
 		additionalPacks = additionalPacksFlag
 	}
-	if languageFlag != "" {
-		language = languageFlag
-	}
 	if sessionNameFlag != "" {
 		sessionName = sessionNameFlag
 	}
@@ -91,40 +87,66 @@ func submitQuery() {
 	if querySuiteFileFlag != "" {
 		querySuiteFile = querySuiteFileFlag
 	}
-	if actionBranchFlag != "" {
-		actionBranch = actionBranchFlag
-	}
 
 	if codeqlPath != "" {
 		if additionalPacks != "" {
-			additionalPacks = ":" + codeqlPath
+			additionalPacks = additionalPacks + string(os.PathListSeparator) + codeqlPath
 		} else {
 			additionalPacks = codeqlPath
 		}
 	}
 
+	var modelPacks []utils.PackRef
+	for _, pack := range modelPackFlag {
+		modelPack, dir, err := utils.ResolveModelPack(pack)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if dir != "" {
+			if additionalPacks != "" {
+				additionalPacks = additionalPacks + string(os.PathListSeparator) + dir
+			} else {
+				additionalPacks = dir
+			}
+		}
+		modelPacks = append(modelPacks, modelPack)
+	}
+
 	if controller == "" {
-		fmt.Println("Please specify a controller.")
-		os.Exit(1)
+		utils.Fatalf("Please specify a controller.")
+	}
+	if language == "" {
+		utils.Fatalf("Please specify a language.")
 	}
 	if listFile == "" {
-		fmt.Println("Please specify a list file.")
-		os.Exit(1)
+		utils.Fatalf("Please specify a list file.")
 	}
 	if listName == "" {
-		fmt.Println("Please specify a list name.")
-		os.Exit(1)
+		utils.Fatalf("Please specify a list name.")
 	}
-	if queryFile == "" && querySuiteFile == "" {
-		fmt.Println("Please specify a query or query suite.")
-		os.Exit(1)
+	if queryFile == "" && querySuiteFile == "" && packFlag == "" {
+		utils.Fatalf("Please specify a query, query suite or pack.")
 	}
 
 	if _, _, _, err := utils.LoadSession(sessionName); err == nil {
-		fmt.Println("Session already exists.")
-		os.Exit(1)
+		utils.Fatalf("Session already exists.")
 	}
 
+	// like local-run, use the installed distribution of the pinned version, if any
+	if codeqlVersionFlag != "" {
+		if err := utils.ValidateVersion(codeqlVersionFlag); err != nil {
+			log.Fatal(err)
+		}
+		if codeqlCLIFlag == "" {
+			utils.UseCodeQLVersion(codeqlVersionFlag)
+		}
+	}
+	codeqlVersion, err := utils.CheckCodeQLVersion(codeqlVersionFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.Printf("Using CodeQL CLI %s (%s)\n", codeqlVersion, utils.GetCodeQLCLI())
+
 	// read list of target repositories
 	repositories, err := utils.ResolveRepositories(listFile, listName)
 	if err != nil {
@@ -137,41 +159,93 @@ func submitQuery() {
 		queries = append(queries, queryFileFlag)
 	} else if querySuiteFileFlag != "" {
 		queries = utils.ResolveQueries(additionalPacks, querySuiteFile)
+	} else if packFlag != "" {
+		packRef, err := utils.ParsePackRef(packFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		packDir, err := utils.DownloadPack(packRef)
+		if err != nil {
+			log.Fatal(err)
+		}
+		queries = utils.ResolvePackQueries(packRef, packDir, additionalPacks)
+	}
+
+	var chunks [][]string
+	for i := 0; i < len(repositories); i += config.MAX_MRVA_REPOSITORIES {
+		end := i + config.MAX_MRVA_REPOSITORIES
+		if end > len(repositories) {
+			end = len(repositories)
+		}
+		chunks = append(chunks, repositories[i:end])
 	}
 
-	fmt.Printf("Submitting %d queries for %d repositories\n", len(queries), len(repositories))
 	var runs []models.Run
-	for _, query := range queries {
-		encodedBundle, queryId, err := utils.GenerateQueryPack(query, language, additionalPacks)
+	if bundleSuiteFlag && len(queries) > 1 {
+		suite := querySuiteFile
+		if suite == "" {
+			suite = packFlag
+		}
+		utils.Printf("Submitting %d queries in a single query pack for %d repositories\n", len(queries), len(repositories))
+		encodedBundle, bundledQueries, err := utils.GenerateSuitePack(queries, language, additionalPacks, modelPacks)
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Printf("Generated encoded bundle for %s (%s)\n", query, queryId)
-
-		var chunks [][]string
-		for i := 0; i < len(repositories); i += config.MAX_MRVA_REPOSITORIES {
-			end := i + config.MAX_MRVA_REPOSITORIES
-			if end > len(repositories) {
-				end = len(repositories)
-			}
-			chunks = append(chunks, repositories[i:end])
-		}
-		for _, chunk := range chunks {
-			id, err := utils.SubmitRun(controller, language, chunk, encodedBundle, actionBranch)
+		utils.Printf("Generated encoded bundle for %s (%d queries)\n", suite, len(bundledQueries))
+		utils.EmitEvent(models.Event{Type: utils.PackCompiledEvent, Session: sessionName, Query: suite, Language: language, Count: len(bundledQueries), Data: bundledQueries})
+		runs = submitChunks(chunks, encodedBundle, models.Run{Query: suite, QueryId: bundleQueryId(querySuiteFile, packFlag), Queries: bundledQueries})
+	} else {
+		utils.Printf("Submitting %d queries for %d repositories\n", len(queries), len(repositories))
+		for _, query := range queries {
+			encodedBundle, metadata, err := utils.GenerateQueryPack(query, language, additionalPacks, modelPacks)
 			if err != nil {
 				log.Fatal(err)
 			}
-			runs = append(runs, models.Run{Id: id, Query: query, QueryId: queryId})
+			queryId := metadata["id"]
+			utils.Printf("Generated encoded bundle for %s (%s)\n", query, queryId)
+			utils.EmitEvent(models.Event{Type: utils.PackCompiledEvent, Session: sessionName, Query: query, QueryId: queryId, Language: language, Data: metadata})
+			runs = append(runs, submitChunks(chunks, encodedBundle, models.Run{Query: query, QueryId: queryId, Metadata: metadata})...)
 		}
-
 	}
 	if querySuiteFile != "" {
-		err = utils.SaveSession(sessionName, controller, runs, language, listFile, listName, querySuiteFile, len(repositories))
+		err = utils.SaveSession(sessionName, controller, runs, language, listFile, listName, querySuiteFile, len(repositories), codeqlVersionFlag, codeqlVersion)
 	} else if queryFile != "" {
-		err = utils.SaveSession(sessionName, controller, runs, language, listFile, listName, queryFile, len(repositories))
+		err = utils.SaveSession(sessionName, controller, runs, language, listFile, listName, queryFile, len(repositories), codeqlVersionFlag, codeqlVersion)
+	} else if packFlag != "" {
+		err = utils.SaveSession(sessionName, controller, runs, language, listFile, listName, packFlag, len(repositories), codeqlVersionFlag, codeqlVersion)
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Done!")
+	utils.EmitEvent(models.Event{Type: utils.SessionSavedEvent, Session: sessionName, Language: language, Count: len(runs)})
+	utils.Println("Done!")
+}
+
+// bundleQueryId returns the id of a run bundling the queries of a suite file
+// or a pack: the name of the suite or of the pack. The queries keep their own
+// ids, this one keys the run itself like the query id of other runs.
+func bundleQueryId(suiteFile string, pack string) string {
+	if pack != "" {
+		if packRef, err := utils.ParsePackRef(pack); err == nil {
+			return packRef.Name
+		}
+		return pack
+	}
+	return strings.TrimSuffix(filepath.Base(suiteFile), filepath.Ext(suiteFile))
+}
+
+// submitChunks submits a query pack once per chunk of repositories and returns
+// the runs, which share the query details of run.
+func submitChunks(chunks [][]string, encodedBundle string, run models.Run) []models.Run {
+	var runs []models.Run
+	for _, chunk := range chunks {
+		id, err := utils.SubmitRun(controller, language, chunk, encodedBundle, actionBranch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		run.Id = id
+		runs = append(runs, run)
+		utils.EmitEvent(models.Event{Type: utils.RunSubmittedEvent, Session: sessionName, RunId: id, Query: run.Query, QueryId: run.QueryId, Language: language, Count: len(chunk)})
+	}
+	return runs
 }
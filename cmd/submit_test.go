@@ -0,0 +1,20 @@
+package cmd
+
+import "testing"
+
+func TestBundleQueryId(t *testing.T) {
+	tests := []struct {
+		suiteFile string
+		pack      string
+		want      string
+	}{
+		{"codeql-suites/java-security.qls", "", "java-security"},
+		{"", "codeql/java-queries@1.0.0:codeql-suites/java-security.qls", "codeql/java-queries"},
+		{"", "codeql/java-queries", "codeql/java-queries"},
+	}
+	for _, tt := range tests {
+		if got := bundleQueryId(tt.suiteFile, tt.pack); got != tt.want {
+			t.Errorf("bundleQueryId(%q, %q) = %q, want %q", tt.suiteFile, tt.pack, got, tt.want)
+		}
+	}
+}
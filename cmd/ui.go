@@ -0,0 +1,484 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/GitHubSecurityLab/gh-mrva/utils"
+	"github.com/cli/go-gh/pkg/browser"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const (
+	sessionsView = iota
+	runsView
+	reposView
+	findingsView
+)
+
+var uiCmd = &cobra.Command{
+	Use:   "ui",
+	Short: "Browse sessions and results in an interactive terminal UI.",
+	Long: `Browse sessions and results in an interactive terminal UI.
+
+Sessions are read from the session store, run and repository details are fetched
+from the API and findings are read from the SARIF files in the output directory.
+
+Key bindings:
+  up/k, down/j   Move the selection
+  enter/right/l  Drill into the selected entry
+  left/h/esc     Go back
+  s              Sort repositories by count or stars
+  d              Download the SARIF file of the selected repository
+  o              Open the selected finding or repository in the browser
+  t              Cycle the triage state of the selected finding
+  q              Quit`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runUI()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(uiCmd)
+	uiCmd.Flags().StringVarP(&outputDirFlag, "output-dir", "o", "", "Directory containing downloaded SARIF files (default: current directory)")
+	uiCmd.Flags().StringVarP(&layoutFlag, "layout", "", "", "Template for the artifact paths used by download (overrides config file)")
+}
+
+type uiState struct {
+	view     int
+	cursor   []int
+	sessions []models.Session
+	session  models.Session
+	details  map[int]map[string]interface{}
+	run      models.Run
+	repos    []models.RepoWithFindings
+	sortBy   string
+	repo     models.RepoWithFindings
+	findings []models.Finding
+	triage   map[string]string
+	layout   string
+	message  string
+}
+
+func runUI() {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		log.Fatal("The ui command requires an interactive terminal")
+	}
+	// outputDirFlag is shared with other commands, whose default must not be
+	// overridden by the one of ui
+	if outputDirFlag == "" {
+		outputDirFlag = "."
+	}
+	sessions, err := utils.GetSessions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	triage, err := utils.GetTriage()
+	if err != nil {
+		log.Fatal(err)
+	}
+	state := &uiState{
+		view:    sessionsView,
+		cursor:  make([]int, 4),
+		details: make(map[int]map[string]interface{}),
+		sortBy:  "count",
+		triage:  triage,
+		layout:  utils.ResolveLayout(layoutFlag),
+	}
+	if err := utils.ValidateLayout(state.layout); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := resolveDownloadLimits(); err != nil {
+		log.Fatal(err)
+	}
+	for _, session := range sessions {
+		state.sessions = append(state.sessions, session)
+	}
+	sort.Slice(state.sessions, func(i, j int) bool {
+		return state.sessions[i].Timestamp.After(state.sessions[j].Timestamp)
+	})
+
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// switch to the alternate screen and hide the cursor
+	utils.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		utils.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(int(os.Stdin.Fd()), oldState)
+	}()
+
+	buf := make([]byte, 8)
+	for {
+		state.render()
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		if !state.handleKey(string(buf[:n])) {
+			return
+		}
+	}
+}
+
+func (s *uiState) itemCount() int {
+	switch s.view {
+	case sessionsView:
+		return len(s.sessions)
+	case runsView:
+		return len(s.session.Runs)
+	case reposView:
+		return len(s.repos)
+	case findingsView:
+		return len(s.findings)
+	}
+	return 0
+}
+
+// handleKey processes a key press and returns false when the UI should exit.
+func (s *uiState) handleKey(key string) bool {
+	s.message = ""
+	cursor := &s.cursor[s.view]
+	switch key {
+	case "q", "\x03":
+		return false
+	case "k", "\x1b[A":
+		if *cursor > 0 {
+			*cursor--
+		}
+	case "j", "\x1b[B":
+		if *cursor < s.itemCount()-1 {
+			*cursor++
+		}
+	case "\r", "l", "\x1b[C":
+		s.enter()
+	case "h", "\x1b", "\x1b[D", "\x7f":
+		if s.view > sessionsView {
+			s.view--
+		}
+	case "s":
+		if s.view == reposView {
+			if s.sortBy == "count" {
+				s.sortBy = "stars"
+			} else {
+				s.sortBy = "count"
+			}
+			s.sortRepos()
+		}
+	case "d":
+		s.download()
+	case "o":
+		s.open()
+	case "t":
+		s.cycleTriage()
+	}
+	return true
+}
+
+func (s *uiState) enter() {
+	if s.itemCount() == 0 {
+		return
+	}
+	cursor := s.cursor[s.view]
+	switch s.view {
+	case sessionsView:
+		s.session = s.sessions[cursor]
+		// sessions are always browsed with the profile and on the host they
+		// were submitted with
+		if err := useSession(s.session.Name); err != nil {
+			s.message = err.Error()
+			return
+		}
+		s.message = "Fetching run details..."
+		s.render()
+		for _, run := range s.session.Runs {
+			if _, ok := s.details[run.Id]; ok {
+				continue
+			}
+			runDetails, err := utils.GetRunDetails(s.session.Controller, run.Id)
+			if err != nil {
+				s.message = fmt.Sprintf("Failed to fetch run %d: %v", run.Id, err)
+				return
+			}
+			s.details[run.Id] = runDetails
+		}
+		s.message = ""
+		s.view = runsView
+		s.cursor[runsView] = 0
+	case runsView:
+		s.run = s.session.Runs[cursor]
+		s.repos = uiReposWithFindings(s.run, s.details[s.run.Id])
+		s.sortRepos()
+		s.view = reposView
+		s.cursor[reposView] = 0
+	case reposView:
+		s.repo = s.repos[cursor]
+		sarifPaths, err := utils.SarifPaths(s.downloadTask(s.repo))
+		if err != nil {
+			s.message = err.Error()
+			return
+		}
+		var findings []models.Finding
+		for _, sarifPath := range sarifPaths {
+			queryFindings, err := utils.LoadFindings(sarifPath)
+			if err != nil {
+				s.message = "No downloaded results for this repository, press 'd' to download them"
+				return
+			}
+			findings = append(findings, queryFindings...)
+		}
+		s.findings = findings
+		s.view = findingsView
+		s.cursor[findingsView] = 0
+	}
+}
+
+func (s *uiState) sortRepos() {
+	sort.SliceStable(s.repos, func(i, j int) bool {
+		if s.sortBy == "stars" {
+			return s.repos[i].Stars > s.repos[j].Stars
+		}
+		return s.repos[i].Count > s.repos[j].Count
+	})
+}
+
+// sarifPath returns the SARIF file of a repository, the one of the first query
+// for runs bundling several queries.
+func (s *uiState) sarifPath(repo models.RepoWithFindings) (string, error) {
+	paths, err := utils.SarifPaths(s.downloadTask(repo))
+	if err != nil {
+		return "", err
+	}
+	return paths[0], nil
+}
+
+func (s *uiState) downloadTask(repo models.RepoWithFindings) models.DownloadTask {
+	task := models.DownloadTask{
+		RunId:       repo.RunId,
+		QueryId:     repo.QueryId,
+		Nwo:         repo.Nwo,
+		Controller:  s.session.Controller,
+		Artifact:    "artifact",
+		Language:    s.session.Language,
+		OutputDir:   outputDirFlag,
+		Session:     s.session.Name,
+		Layout:      s.layout,
+		ResultCount: repo.Count,
+	}
+	for _, run := range s.session.Runs {
+		if run.Id == repo.RunId {
+			task.QueryMetadata = run.Metadata
+			task.Queries = run.Queries
+		}
+	}
+	return task
+}
+
+func (s *uiState) download() {
+	if s.view != reposView || len(s.repos) == 0 {
+		return
+	}
+	repo := s.repos[s.cursor[reposView]]
+	if err := os.MkdirAll(outputDirFlag, 0755); err != nil {
+		s.message = err.Error()
+		return
+	}
+	s.message = fmt.Sprintf("Downloading results for %s...", repo.Nwo)
+	s.render()
+	files, err := utils.DownloadResults(s.downloadTask(repo))
+	if err == nil {
+		err = utils.UpdateManifest(outputDirFlag, files)
+	}
+	if err != nil {
+		s.message = fmt.Sprintf("Failed to download results for %s: %v", repo.Nwo, err)
+	} else {
+		s.message = fmt.Sprintf("Downloaded results for %s", repo.Nwo)
+	}
+}
+
+func (s *uiState) open() {
+	url := ""
+	switch s.view {
+	case reposView:
+		if len(s.repos) > 0 {
+			url = utils.WebURL(s.repos[s.cursor[reposView]].Nwo)
+		}
+	case findingsView:
+		if len(s.findings) > 0 {
+			finding := s.findings[s.cursor[findingsView]]
+			ref := "HEAD"
+			repoDetails, err := utils.GetRunRepositoryDetails(s.session.Controller, s.repo.RunId, s.repo.Nwo)
+			if err == nil {
+				if sha, ok := repoDetails["database_commit_sha"].(string); ok && sha != "" {
+					ref = sha
+				}
+			}
+			url = utils.WebURL(fmt.Sprintf("%s/blob/%s/%s#L%d", s.repo.Nwo, ref, finding.Path, finding.StartLine))
+		}
+	}
+	if url == "" {
+		return
+	}
+	b := browser.New("", os.Stderr, os.Stderr)
+	if err := b.Browse(url); err != nil {
+		s.message = fmt.Sprintf("Failed to open %s: %v", url, err)
+	} else {
+		s.message = fmt.Sprintf("Opened %s", url)
+	}
+}
+
+func (s *uiState) cycleTriage() {
+	if s.view != findingsView || len(s.findings) == 0 {
+		return
+	}
+	key := utils.TriageKey(s.repo.Nwo, s.findings[s.cursor[findingsView]])
+	next := utils.TriageStates[0]
+	for i, state := range utils.TriageStates {
+		if state == s.triageState(key) {
+			next = utils.TriageStates[(i+1)%len(utils.TriageStates)]
+			break
+		}
+	}
+	if err := utils.SetTriageState(key, next); err != nil {
+		s.message = fmt.Sprintf("Failed to save triage state: %v", err)
+		return
+	}
+	s.triage[key] = next
+}
+
+func (s *uiState) triageState(key string) string {
+	if state, ok := s.triage[key]; ok {
+		return state
+	}
+	return utils.TriageStates[0]
+}
+
+func (s *uiState) render() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	var title string
+	var help string
+	var lines []string
+	switch s.view {
+	case sessionsView:
+		title = "Sessions"
+		help = "enter: open  q: quit"
+		for _, session := range s.sessions {
+			lines = append(lines, fmt.Sprintf("%-30s %-10s %4d runs  %5d repos  %s", session.Name, session.Language, len(session.Runs), session.RepositoryCount, session.Timestamp.Format("2006-01-02 15:04")))
+		}
+	case runsView:
+		title = fmt.Sprintf("Sessions > %s", s.session.Name)
+		help = "enter: open  esc: back  q: quit"
+		for _, run := range s.session.Runs {
+			runDetails := s.details[run.Id]
+			status, _ := runDetails["status"].(string)
+			lines = append(lines, fmt.Sprintf("%-12d %-12s %4d repos with findings  %s", run.Id, status, len(uiReposWithFindings(run, runDetails)), run.QueryId))
+		}
+	case reposView:
+		title = fmt.Sprintf("Sessions > %s > %d (%s)", s.session.Name, s.run.Id, s.run.QueryId)
+		help = fmt.Sprintf("enter: findings  s: sort (%s)  d: download  o: open  esc: back  q: quit", s.sortBy)
+		for _, repo := range s.repos {
+			downloaded := " "
+			if sarifPath, err := s.sarifPath(repo); err == nil {
+				if _, err := os.Stat(sarifPath); err == nil {
+					downloaded = "*"
+				}
+			}
+			lines = append(lines, fmt.Sprintf("%s %-50s %6d results  %7d stars", downloaded, repo.Nwo, repo.Count, repo.Stars))
+		}
+	case findingsView:
+		title = fmt.Sprintf("Sessions > %s > %d > %s", s.session.Name, s.run.Id, s.repo.Nwo)
+		help = "t: triage  o: open  esc: back  q: quit"
+		for _, finding := range s.findings {
+			lines = append(lines, fmt.Sprintf("[%-14s] %s:%d  %s", s.triageState(utils.TriageKey(s.repo.Nwo, finding)), finding.Path, finding.StartLine, strings.ReplaceAll(finding.Message, "\n", " ")))
+		}
+	}
+
+	// reserve space for the title, the help line, the message and the snippet
+	var snippet []string
+	if s.view == findingsView && len(s.findings) > 0 {
+		snippet = strings.Split(strings.TrimRight(s.findings[s.cursor[findingsView]].Snippet, "\n"), "\n")
+		if len(snippet) > height/3 {
+			snippet = snippet[:height/3]
+		}
+	}
+	listHeight := height - 4 - len(snippet)
+	if len(snippet) > 0 {
+		listHeight--
+	}
+	if listHeight < 1 {
+		listHeight = 1
+	}
+	cursor := s.cursor[s.view]
+	offset := 0
+	if cursor >= listHeight {
+		offset = cursor - listHeight + 1
+	}
+
+	var out strings.Builder
+	out.WriteString("\x1b[H\x1b[2J")
+	out.WriteString("\x1b[1m" + uiTruncate("gh mrva: "+title, width) + "\x1b[0m\r\n\r\n")
+	for i := offset; i < len(lines) && i < offset+listHeight; i++ {
+		line := uiTruncate(lines[i], width-2)
+		if i == cursor {
+			out.WriteString("\x1b[7m> " + line + "\x1b[0m\r\n")
+		} else {
+			out.WriteString("  " + line + "\r\n")
+		}
+	}
+	if len(lines) == 0 {
+		out.WriteString("  (empty)\r\n")
+	}
+	if len(snippet) > 0 {
+		out.WriteString("\r\n")
+		for _, line := range snippet {
+			out.WriteString("\x1b[2m" + uiTruncate("  "+line, width) + "\x1b[0m\r\n")
+		}
+	}
+	out.WriteString(fmt.Sprintf("\x1b[%d;1H", height-1))
+	out.WriteString(uiTruncate(s.message, width) + "\r\n")
+	out.WriteString("\x1b[2m" + uiTruncate(help, width) + "\x1b[0m")
+	utils.Print(out.String())
+}
+
+func uiTruncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return s
+}
+
+func uiReposWithFindings(run models.Run, runDetails map[string]interface{}) []models.RepoWithFindings {
+	var repos []models.RepoWithFindings
+	scannedRepos, _ := runDetails["scanned_repositories"].([]interface{})
+	for _, r := range scannedRepos {
+		repo := r.(map[string]interface{})
+		resultCount, _ := repo["result_count"].(float64)
+		if repo["analysis_status"] != "succeeded" || resultCount == 0 {
+			continue
+		}
+		repoInfo := repo["repository"].(map[string]interface{})
+		stars, _ := repoInfo["stargazers_count"].(float64)
+		repos = append(repos, models.RepoWithFindings{
+			Nwo:     repoInfo["full_name"].(string),
+			Query:   run.Query,
+			QueryId: run.QueryId,
+			Count:   int(resultCount),
+			RunId:   run.Id,
+			Stars:   int(stars),
+		})
+	}
+	return repos
+}
@@ -2,5 +2,23 @@ package config
 
 const (
 	MAX_MRVA_REPOSITORIES = 1000
-	WORKERS               = 10
+	// concurrent downloads of repository artifacts and databases
+	ARTIFACT_WORKERS = 10
+	DATABASE_WORKERS = 4
+	// retries of requests rejected by the API rate limits
+	MAX_RETRIES         = 5
+	MIN_BACKOFF_SECONDS = 5
+	MAX_BACKOFF_SECONDS = 120
+	// oldest CodeQL CLI supporting the options used to bundle query packs (--qlx)
+	MIN_CODEQL_VERSION = "2.11.3"
+	// default location of the CodeQL CLI archives installed with 'codeql install'
+	CODEQL_DOWNLOAD_URL = "https://github.com/github/codeql-cli-binaries/releases/download/v{{.Version}}/codeql-{{.Platform}}.zip"
+	// version of the schema of the events emitted with --output json-lines
+	EVENT_SCHEMA_VERSION = 1
+	// maximum decompressed size of a repository artifact
+	MAX_ARTIFACT_SIZE_MB = 1024
+	// project-local configuration file, looked up from the working directory upwards
+	PROJECT_CONFIG_FILE = ".gh-mrva.yml"
+	// prefix of the environment variables overriding config options
+	CONFIG_ENV_PREFIX = "GH_MRVA_"
 )
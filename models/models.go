@@ -5,37 +5,136 @@ import (
 )
 
 type Run struct {
-	Id      int    `yaml:"id"`
-	Query   string `yaml:"query"`
-	QueryId string `yaml:"query_id"`
+	Id       int               `yaml:"id"`
+	Query    string            `yaml:"query"`
+	QueryId  string            `yaml:"query_id"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	// queries bundled in the query pack of the run, for suites submitted with --bundle-suite
+	Queries []RunQuery `yaml:"queries,omitempty"`
+}
+
+// RunQuery is one of the queries of a run bundling a whole suite.
+type RunQuery struct {
+	Query    string            `yaml:"query"`
+	QueryId  string            `yaml:"query_id"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
 }
 
 type Session struct {
-	Name            string    `yaml:"name" json:"name"`
-	Timestamp       time.Time `yaml:"timestamp" json:"timestamp"`
-	Runs            []Run     `yaml:"runs" json:"runs"`
-	Controller      string    `yaml:"controller" json:"controller"`
-	ListFile        string    `yaml:"list_file" json:"list_file"`
-	List            string    `yaml:"list" json:"list"`
-	Language        string    `yaml:"language" json:"language"`
-	RepositoryCount int       `yaml:"repository_count" json:"repository_count"`
+	Name             string    `yaml:"name" json:"name"`
+	Timestamp        time.Time `yaml:"timestamp" json:"timestamp"`
+	Runs             []Run     `yaml:"runs" json:"runs"`
+	Controller       string    `yaml:"controller" json:"controller"`
+	ListFile         string    `yaml:"list_file" json:"list_file"`
+	List             string    `yaml:"list" json:"list"`
+	Language         string    `yaml:"language" json:"language"`
+	RepositoryCount  int       `yaml:"repository_count" json:"repository_count"`
+	CodeQLVersion    string    `yaml:"codeql_version,omitempty" json:"codeql_version,omitempty"`
+	CodeQLCLIVersion string    `yaml:"codeql_cli_version,omitempty" json:"codeql_cli_version,omitempty"`
+	Profile          string    `yaml:"profile,omitempty" json:"profile,omitempty"`
+	Host             string    `yaml:"host,omitempty" json:"host,omitempty"`
 }
 
 type Config struct {
-	Controller string `yaml:"controller"`
-	ListFile   string `yaml:"list_file"`
-	CodeQLPath string `yaml:"codeql_path"`
+	Controller            string            `yaml:"controller"`
+	ListFile              string            `yaml:"list_file"`
+	CodeQLPath            string            `yaml:"codeql_path"`
+	CodeQLCLI             string            `yaml:"codeql_cli"`
+	CodeQLMirror          string            `yaml:"codeql_mirror"`
+	Host                  string            `yaml:"host"`
+	Language              string            `yaml:"language"`
+	ActionBranch          string            `yaml:"action_branch"`
+	SuppressionsFile      string            `yaml:"suppressions_file"`
+	Layout                string            `yaml:"layout"`
+	ArtifactWorkers       int               `yaml:"artifact_workers"`
+	DatabaseWorkers       int               `yaml:"database_workers"`
+	BandwidthLimit        string            `yaml:"bandwidth_limit"`
+	MaxConnectionsPerHost int               `yaml:"max_connections_per_host"`
+	Profiles              map[string]Config `yaml:"profiles,omitempty"`
+}
+
+// ConfigSetting is the effective value of a config option and the layer it
+// comes from: default, user config, project config, profile, env or flag.
+type ConfigSetting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source,omitempty"`
+}
+
+// DoctorCheck is the outcome of one of the checks run by doctor.
+type DoctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+type DownloadLimits struct {
+	ArtifactWorkers       int
+	DatabaseWorkers       int
+	BandwidthLimit        int64
+	MaxConnectionsPerHost int
+}
+
+type CodeQLDistribution struct {
+	Version     string    `json:"version"`
+	Source      string    `json:"source"`
+	Sha256      string    `json:"sha256"`
+	InstalledAt time.Time `json:"installed_at"`
+	Path        string    `json:"path,omitempty"`
+	Selected    bool      `json:"selected,omitempty"`
+}
+
+type Suppression struct {
+	Repository    string    `yaml:"repository" json:"repository,omitempty"`
+	Rule          string    `yaml:"rule" json:"rule,omitempty"`
+	Path          string    `yaml:"path" json:"path,omitempty"`
+	Fingerprint   string    `yaml:"fingerprint" json:"fingerprint,omitempty"`
+	Expires       time.Time `yaml:"expires" json:"expires,omitempty"`
+	Justification string    `yaml:"justification" json:"justification,omitempty"`
+}
+
+type SuppressionsFile struct {
+	Suppressions []Suppression `yaml:"suppressions"`
 }
 
 type DownloadTask struct {
-	RunId          int
-	QueryId        string
-	Nwo            string
-	Controller     string
-	Artifact       string
-	OutputDir      string
-	OutputFilename string
-	Language       string
+	RunId       int
+	QueryId     string
+	Nwo         string
+	Controller  string
+	Artifact    string
+	OutputDir   string
+	Language    string
+	Session     string
+	Layout      string
+	ResultCount int
+	CommitSha   string
+	Files       []ManifestEntry
+	// FullArtifact keeps every file of the artifact instead of only the results
+	FullArtifact    bool
+	MaxArtifactSize int64
+	QueryMetadata   map[string]string
+	// queries bundled in the run, whose results are also split by query id
+	Queries []RunQuery
+	Err     error
+}
+
+type ManifestEntry struct {
+	Path        string `json:"path"`
+	Artifact    string `json:"artifact"`
+	RunId       int    `json:"run_id"`
+	Nwo         string `json:"nwo"`
+	QueryId     string `json:"query_id"`
+	CommitSha   string `json:"commit_sha"`
+	ResultCount int    `json:"result_count"`
+	Sha256      string `json:"sha256"`
+	// results of a SARIF file marked as suppressed when it was downloaded
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+type Manifest struct {
+	Files []ManifestEntry `json:"files"`
 }
 
 type RunStatus struct {
@@ -69,4 +168,59 @@ type Results struct {
 	TotalSkippedNotFoundRepositories       int                `json:"total_skipped_not_found_repositories"`
 	TotalSkippedNoDatabaseRepositories     int                `json:"total_skipped_no_database_repositories"`
 	TotalSkippedOverLimitRepositories      int                `json:"total_skipped_over_limit_repositories"`
+	SuppressedRepositories                 []RepoWithFindings `json:"suppressed_repositories"`
+	TotalSuppressedFindingsCount           int                `json:"total_suppressed_findings_count"`
+	TotalSuppressedRepositories            int                `json:"total_suppressed_repositories"`
+	Repositories                           []RepoStatus       `json:"repositories,omitempty"`
+}
+
+type Finding struct {
+	RuleId      string `json:"rule_id"`
+	Message     string `json:"message"`
+	Path        string `json:"path"`
+	StartLine   int    `json:"start_line"`
+	Snippet     string `json:"snippet"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type RepoStatus struct {
+	RunId             int    `json:"run_id"`
+	QueryId           string `json:"query_id"`
+	Nwo               string `json:"nwo"`
+	State             string `json:"state"`
+	FailureMessage    string `json:"failure_message,omitempty"`
+	SkipReason        string `json:"skip_reason,omitempty"`
+	ResultCount       int    `json:"result_count"`
+	Stars             int    `json:"stars"`
+	ArtifactSize      int    `json:"artifact_size_in_bytes"`
+	DatabaseCommitSha string `json:"database_commit_sha,omitempty"`
+}
+
+type CachedDatabase struct {
+	Nwo          string    `json:"nwo"`
+	Language     string    `json:"language"`
+	CommitSha    string    `json:"commit_sha"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+	Path         string    `json:"path"`
+	Sha256       string    `json:"sha256"`
+	Extracted    string    `json:"extracted,omitempty"`
+}
+
+type Event struct {
+	Version   int         `json:"version"`
+	Timestamp time.Time   `json:"timestamp"`
+	Type      string      `json:"type"`
+	Session   string      `json:"session,omitempty"`
+	RunId     int         `json:"run_id,omitempty"`
+	Query     string      `json:"query,omitempty"`
+	QueryId   string      `json:"query_id,omitempty"`
+	Nwo       string      `json:"nwo,omitempty"`
+	Language  string      `json:"language,omitempty"`
+	Artifact  string      `json:"artifact,omitempty"`
+	Files     []string    `json:"files,omitempty"`
+	Count     int         `json:"count,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
 }
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+)
+
+var (
+	codeqlCLI         = "codeql"
+	codeqlVersionOnce sync.Once
+	codeqlVersion     string
+	codeqlVersionErr  error
+)
+
+// GetCodeQLCLI returns the CodeQL CLI binary used by RunCodeQLCommand.
+func GetCodeQLCLI() string {
+	return codeqlCLI
+}
+
+// SetCodeQLCLI selects the CodeQL CLI binary used by RunCodeQLCommand.
+func SetCodeQLCLI(path string) {
+	codeqlCLI = path
+	codeqlVersionOnce = sync.Once{}
+}
+
+// ResolveCodeQLCLI returns the CodeQL CLI binary from the flag value, the
+// distribution selected with 'codeql use', the codeql_cli config option or, if
+// it points to a CLI rather than to a checkout of the CodeQL libraries, the
+// codeql_path config option. It defaults to the codeql found in PATH.
+func ResolveCodeQLCLI(flagValue string) (string, error) {
+	candidates := []string{flagValue}
+	configData, err := GetConfig()
+	if err != nil {
+		return "", err
+	}
+	// 'codeql use' is an explicit choice, it wins over the config files
+	if selected := GetSelectedCodeQLVersion(); selected != "" {
+		distribution, err := GetCodeQLDistribution(selected)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, distribution.Path)
+	}
+	candidates = append(candidates, configData.CodeQLCLI)
+	if FindCodeQLBinary(configData.CodeQLPath) != "" {
+		candidates = append(candidates, configData.CodeQLPath)
+	}
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if binary := FindCodeQLBinary(candidate); binary != "" {
+			return binary, nil
+		}
+		return "", fmt.Errorf("No CodeQL CLI found at %s", candidate)
+	}
+	return "codeql", nil
+}
+
+// ResolveCodeQLLibraries returns the checkout of the CodeQL libraries from the
+// flag value or the codeql_path config option. A codeql_path pointing to a
+// CLI binary is not a library path.
+func ResolveCodeQLLibraries(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	configData, err := GetConfig()
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Stat(configData.CodeQLPath); err == nil && !info.IsDir() {
+		return ""
+	}
+	return configData.CodeQLPath
+}
+
+// FindCodeQLBinary returns the CodeQL binary at path, which can be the binary
+// itself or the directory of a CodeQL CLI distribution.
+func FindCodeQLBinary(path string) string {
+	if path == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	if !info.IsDir() {
+		return path
+	}
+	name := "codeql"
+	if runtime.GOOS == "windows" {
+		name = "codeql.exe"
+	}
+	binary := filepath.Join(path, name)
+	if info, err := os.Stat(binary); err == nil && !info.IsDir() {
+		return binary
+	}
+	return ""
+}
+
+// GetCodeQLVersion returns the version of the selected CodeQL CLI.
+func GetCodeQLVersion() (string, error) {
+	codeqlVersionOnce.Do(func() {
+		codeqlVersion, codeqlVersionErr = detectCodeQLVersion(codeqlCLI)
+	})
+	return codeqlVersion, codeqlVersionErr
+}
+
+func detectCodeQLVersion(binary string) (string, error) {
+	output, err := exec.Command(binary, "version", "--format=json").Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run %s: %v", binary, err)
+	}
+	var version struct {
+		Version string `json:"version"`
+	}
+	err = json.Unmarshal(output, &version)
+	if err != nil || version.Version == "" {
+		return "", fmt.Errorf("Failed to detect the version of %s", binary)
+	}
+	return version.Version, nil
+}
+
+// UseCodeQLVersion switches to the installed distribution of a version, if
+// there is one, and reports whether it did.
+func UseCodeQLVersion(version string) bool {
+	distribution, err := GetCodeQLDistribution(version)
+	if err != nil {
+		return false
+	}
+	SetCodeQLCLI(distribution.Path)
+	return true
+}
+
+// CheckCodeQLVersion verifies that the selected CodeQL CLI is recent enough
+// and, if a version is pinned, that it is that version.
+func CheckCodeQLVersion(pinnedVersion string) (string, error) {
+	version, err := GetCodeQLVersion()
+	if err != nil {
+		return "", err
+	}
+	if CompareVersions(version, config.MIN_CODEQL_VERSION) < 0 {
+		return version, fmt.Errorf("CodeQL CLI %s is not supported, version %s or newer is required", version, config.MIN_CODEQL_VERSION)
+	}
+	if pinnedVersion != "" && CompareVersions(version, pinnedVersion) != 0 {
+		return version, fmt.Errorf("CodeQL CLI %s does not match the pinned version %s", version, pinnedVersion)
+	}
+	return version, nil
+}
+
+// CompareVersions compares two dotted version numbers, ignoring a leading v
+// and any pre-release suffix.
+func CompareVersions(a string, b string) int {
+	aParts := versionParts(a)
+	bParts := versionParts(b)
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(version string) []int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		n, _ := strconv.Atoi(part)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// ValidateVersion checks that a version given by the user is a dotted version
+// number.
+func ValidateVersion(version string) error {
+	version = strings.TrimPrefix(version, "v")
+	for _, part := range strings.Split(version, ".") {
+		if _, err := strconv.Atoi(part); err != nil {
+			return errors.New("Invalid version " + version)
+		}
+	}
+	return nil
+}
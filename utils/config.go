@@ -0,0 +1,478 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"gopkg.in/yaml.v3"
+)
+
+// config options given on the command line, by key
+var configOverrides map[string]string
+
+// config options holding paths, resolved relative to the project config file
+var configPathKeys = map[string]bool{
+	"list_file":         true,
+	"codeql_path":       true,
+	"codeql_cli":        true,
+	"suppressions_file": true,
+}
+
+// SetConfigOverrides sets the config options given with command line flags,
+// which take precedence over every other layer.
+func SetConfigOverrides(overrides map[string]string) {
+	configOverrides = overrides
+}
+
+// GetConfig returns the effective configuration. The layers are, from lowest
+// to highest precedence: the defaults, the user config file, the project config
+// file, the active profile, the GH_MRVA_* environment variables and the flags.
+// Missing config files are not an error.
+func GetConfig() (models.Config, error) {
+	configData, _, err := LoadConfig()
+	return configData, err
+}
+
+// LoadConfig returns the effective configuration and the layer each option
+// comes from.
+func LoadConfig() (models.Config, map[string]string, error) {
+	configData := defaultConfig()
+	sources := map[string]string{}
+	for _, key := range ConfigKeys() {
+		if value, _ := GetConfigValue(configData, key); value != "" {
+			sources[key] = "default"
+		}
+	}
+
+	userConfig, err := readConfigFile(configFilePath)
+	if err != nil {
+		return configData, sources, err
+	}
+	configData = mergeConfig(configData, userConfig, "user config", sources)
+
+	projectConfig := models.Config{}
+	if projectFile := FindProjectConfigFile(); projectFile != "" {
+		projectConfig, err = readConfigFile(projectFile)
+		if err != nil {
+			return configData, sources, err
+		}
+		configData = mergeConfig(configData, projectConfig, "project config", sources)
+	}
+
+	// profiles of the project config replace the user ones with the same name
+	profiles := map[string]models.Config{}
+	for name, profile := range userConfig.Profiles {
+		profiles[name] = profile
+	}
+	for name, profile := range projectConfig.Profiles {
+		profiles[name] = profile
+	}
+	if profile, ok := profiles[activeProfile]; ok && activeProfile != "" {
+		configData = mergeConfig(configData, profile, "profile "+activeProfile, sources)
+	}
+	if len(profiles) > 0 {
+		configData.Profiles = profiles
+	}
+
+	envConfig, errs := readConfigEnv()
+	if len(errs) > 0 {
+		return configData, sources, errors.Join(errs...)
+	}
+	configData = mergeConfig(configData, envConfig, "env", sources)
+
+	flagConfig := models.Config{}
+	for key, value := range configOverrides {
+		if err := ValidateConfigValue(key, value); err != nil {
+			return configData, sources, err
+		}
+		setConfigValue(&flagConfig, key, value)
+	}
+	configData = mergeConfig(configData, flagConfig, "flag", sources)
+	return configData, sources, nil
+}
+
+func defaultConfig() models.Config {
+	return models.Config{
+		ActionBranch:    "main",
+		ArtifactWorkers: config.ARTIFACT_WORKERS,
+		DatabaseWorkers: config.DATABASE_WORKERS,
+		CodeQLMirror:    config.CODEQL_DOWNLOAD_URL,
+	}
+}
+
+// mergeConfig overrides the options of a configuration with the ones set in a
+// layer, recording the layer as their source.
+func mergeConfig(configData models.Config, layer models.Config, source string, sources map[string]string) models.Config {
+	merged := applyProfile(configData, layer)
+	for _, key := range ConfigKeys() {
+		if value, _ := GetConfigValue(layer, key); value != "" {
+			sources[key] = source
+		}
+	}
+	return merged
+}
+
+// ConfigKeys returns the keys of the config options, as used in the config
+// files.
+func ConfigKeys() []string {
+	var keys []string
+	configType := reflect.TypeOf(models.Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		key := configKey(configType.Field(i))
+		if key != "profiles" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func configKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+func configField(configData *models.Config, key string) (reflect.Value, error) {
+	value := reflect.ValueOf(configData).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if key != "profiles" && configKey(value.Type().Field(i)) == key {
+			return value.Field(i), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("Unknown config option '%s'. Valid options are %s", key, strings.Join(ConfigKeys(), ", "))
+}
+
+// GetConfigValue returns the value of a config option as a string.
+func GetConfigValue(configData models.Config, key string) (string, error) {
+	field, err := configField(&configData, key)
+	if err != nil {
+		return "", err
+	}
+	if field.Kind() == reflect.Int {
+		if field.Int() == 0 {
+			return "", nil
+		}
+		return strconv.FormatInt(field.Int(), 10), nil
+	}
+	return field.String(), nil
+}
+
+func setConfigValue(configData *models.Config, key string, value string) error {
+	field, err := configField(configData, key)
+	if err != nil {
+		return err
+	}
+	if field.Kind() == reflect.Int {
+		n := 0
+		if value != "" {
+			n, err = strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer, got %q", key, value)
+			}
+		}
+		field.SetInt(int64(n))
+		return nil
+	}
+	field.SetString(value)
+	return nil
+}
+
+// ValidateConfigValue checks the value of a config option.
+func ValidateConfigValue(key string, value string) error {
+	var configData models.Config
+	if err := setConfigValue(&configData, key, value); err != nil {
+		return err
+	}
+	if value == "" {
+		return nil
+	}
+	switch key {
+	case "controller":
+		parts := strings.Split(value, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("controller must be a repository in the owner/name form, got %q", value)
+		}
+	case "artifact_workers", "database_workers", "max_connections_per_host":
+		if n, _ := strconv.Atoi(value); n < 0 {
+			return fmt.Errorf("%s must not be negative", key)
+		}
+	case "bandwidth_limit":
+		if _, err := ParseByteSize(value); err != nil {
+			return fmt.Errorf("invalid bandwidth_limit %q: %v", value, err)
+		}
+	case "layout":
+		if err := ValidateLayout(value); err != nil {
+			return err
+		}
+	case "codeql_mirror":
+		if _, err := template.New("mirror").Parse(value); err != nil {
+			return fmt.Errorf("invalid codeql_mirror template: %v", err)
+		}
+	case "host":
+		if NormalizeHost(value) == "" {
+			return fmt.Errorf("invalid host %q", value)
+		}
+	}
+	return nil
+}
+
+// FindProjectConfigFile returns the project config file found in the working
+// directory or its parents, if any.
+func FindProjectConfigFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, config.PROJECT_CONFIG_FILE)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readConfigFile reads and validates a config file. A missing file is an empty
+// configuration. Relative paths in the project config file are resolved from
+// its directory.
+func readConfigFile(path string) (models.Config, error) {
+	var configData models.Config
+	if path == "" {
+		return configData, nil
+	}
+	document, err := readConfigDocument(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return configData, nil
+		}
+		return configData, err
+	}
+	if errs := validateConfigDocument(path, document); len(errs) > 0 {
+		return configData, errors.Join(errs...)
+	}
+	if len(document.Content) > 0 {
+		if err := document.Decode(&configData); err != nil {
+			return configData, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if filepath.Base(path) == config.PROJECT_CONFIG_FILE {
+		resolveConfigPaths(&configData, filepath.Dir(path))
+		for name, profile := range configData.Profiles {
+			resolveConfigPaths(&profile, filepath.Dir(path))
+			configData.Profiles[name] = profile
+		}
+	}
+	return configData, nil
+}
+
+func resolveConfigPaths(configData *models.Config, dir string) {
+	for key := range configPathKeys {
+		field, _ := configField(configData, key)
+		if path := field.String(); path != "" && !filepath.IsAbs(path) {
+			field.SetString(filepath.Join(dir, path))
+		}
+	}
+}
+
+func readConfigDocument(path string) (*yaml.Node, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &document, nil
+}
+
+// readConfigEnv returns the config options set with GH_MRVA_* environment
+// variables, e.g. GH_MRVA_LIST_FILE for list_file.
+func readConfigEnv() (models.Config, []error) {
+	var configData models.Config
+	var errs []error
+	for _, key := range ConfigKeys() {
+		name := config.CONFIG_ENV_PREFIX + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := ValidateConfigValue(key, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		setConfigValue(&configData, key, value)
+	}
+	return configData, errs
+}
+
+// ValidateConfigFile checks that a config file only sets known options with
+// valid values. The errors point to the offending lines.
+func ValidateConfigFile(path string) []error {
+	document, err := readConfigDocument(path)
+	if err != nil {
+		return []error{err}
+	}
+	return validateConfigDocument(path, document)
+}
+
+// ValidateConfigEnv checks the config options set in the environment.
+func ValidateConfigEnv() []error {
+	_, errs := readConfigEnv()
+	return errs
+}
+
+func validateConfigDocument(path string, document *yaml.Node) []error {
+	if len(document.Content) == 0 {
+		return nil
+	}
+	root := document.Content[0]
+	if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		return nil
+	}
+	return validateConfigMapping(path, root, true)
+}
+
+func validateConfigMapping(path string, node *yaml.Node, topLevel bool) []error {
+	if node.Kind != yaml.MappingNode {
+		return []error{fmt.Errorf("%s:%d: expected a mapping of config options", path, node.Line)}
+	}
+	var errs []error
+	seen := map[string]int{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		key := keyNode.Value
+		if line, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("%s:%d: %s is already set on line %d", path, keyNode.Line, key, line))
+			continue
+		}
+		seen[key] = keyNode.Line
+		if key == "profiles" {
+			if !topLevel {
+				errs = append(errs, fmt.Errorf("%s:%d: profiles cannot be nested", path, keyNode.Line))
+				continue
+			}
+			if valueNode.Kind != yaml.MappingNode {
+				errs = append(errs, fmt.Errorf("%s:%d: profiles must be a mapping of profile names to config options", path, valueNode.Line))
+				continue
+			}
+			for j := 0; j+1 < len(valueNode.Content); j += 2 {
+				errs = append(errs, validateConfigMapping(path, valueNode.Content[j+1], false)...)
+			}
+			continue
+		}
+		if _, err := configField(&models.Config{}, key); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown config option '%s'", path, keyNode.Line, key))
+			continue
+		}
+		if valueNode.Kind != yaml.ScalarNode {
+			errs = append(errs, fmt.Errorf("%s:%d: %s must be a single value", path, valueNode.Line, key))
+			continue
+		}
+		if valueNode.Tag == "!!null" {
+			continue
+		}
+		if err := ValidateConfigValue(key, valueNode.Value); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", path, valueNode.Line, err))
+		}
+	}
+	return errs
+}
+
+// SetConfigFileValue sets a config option in a config file, or in one of its
+// profiles, keeping the rest of the file and its comments. An empty value
+// removes the option.
+func SetConfigFileValue(path string, profile string, key string, value string) error {
+	if err := ValidateConfigValue(key, value); err != nil {
+		return err
+	}
+	document, err := readConfigDocument(path)
+	if errors.Is(err, os.ErrNotExist) {
+		document = &yaml.Node{Kind: yaml.DocumentNode}
+	} else if err != nil {
+		return err
+	}
+	if len(document.Content) == 0 || document.Content[0].Tag == "!!null" {
+		document.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	if errs := validateConfigDocument(path, document); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	mapping := document.Content[0]
+	if profile != "" {
+		profiles := mappingValue(mapping, "profiles", value != "")
+		if profiles == nil {
+			return nil
+		}
+		mapping = mappingValue(profiles, profile, value != "")
+		if mapping == nil {
+			return nil
+		}
+	}
+	setMappingValue(mapping, key, value)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// mappingValue returns the mapping stored under a key, adding it if asked to.
+func mappingValue(mapping *yaml.Node, key string, create bool) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			if mapping.Content[i+1].Kind != yaml.MappingNode {
+				mapping.Content[i+1] = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			return mapping.Content[i+1]
+		}
+	}
+	if !create {
+		return nil
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
+
+func setMappingValue(mapping *yaml.Node, key string, value string) {
+	tag := "!!str"
+	if field, _ := configField(&models.Config{}, key); field.Kind() == reflect.Int {
+		tag = "!!int"
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			continue
+		}
+		if value == "" {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+		mapping.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value, LineComment: mapping.Content[i+1].LineComment}
+		return
+	}
+	if value != "" {
+		mapping.Content = append(mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value})
+	}
+}
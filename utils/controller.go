@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cli/go-gh"
+	"github.com/cli/go-gh/pkg/api"
+)
+
+// controller repository, as returned by the repositories API
+type controllerRepository struct {
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+// NewRESTClient returns a client for the API of the selected host. The
+// controller setup functions take the client as a parameter, so that they can
+// be run against a fake API.
+func NewRESTClient() (api.RESTClient, error) {
+	opts := api.ClientOptions{
+		Host:      GetHost(),
+		Headers:   map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Transport: APITransport(),
+	}
+	return gh.RESTClient(&opts)
+}
+
+// GetAuthenticatedUser returns the login of the user the client is
+// authenticated as.
+func GetAuthenticatedUser(client api.RESTClient) (string, error) {
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := client.Get("user", &user); err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+// EnsureControllerRepository creates the controller repository if it does not
+// exist yet, with an initial commit on its default branch. It reports whether
+// the repository was created.
+func EnsureControllerRepository(client api.RESTClient, controller string, private bool) (bool, error) {
+	owner, name, _ := strings.Cut(controller, "/")
+	var repository controllerRepository
+	err := client.Get("repos/"+controller, &repository)
+	if err == nil {
+		return false, nil
+	}
+	if !isNotFound(err) {
+		return false, err
+	}
+	login, err := GetAuthenticatedUser(client)
+	if err != nil {
+		return false, err
+	}
+	path := "orgs/" + url.PathEscape(owner) + "/repos"
+	if strings.EqualFold(owner, login) {
+		path = "user/repos"
+	}
+	body, err := jsonBody(map[string]interface{}{
+		"name":        name,
+		"description": "Controller repository for Multi-Repository Variant Analysis",
+		"private":     private,
+		"auto_init":   true,
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := client.Post(path, body, &repository); err != nil {
+		return false, fmt.Errorf("Failed to create the controller repository %s: %v", controller, err)
+	}
+	return true, nil
+}
+
+// EnsureDefaultBranch makes sure that the controller repository has a default
+// branch with a commit, which the variant analyses run on. An empty repository
+// gets a README. It returns the default branch and whether it was created.
+func EnsureDefaultBranch(client api.RESTClient, controller string) (string, bool, error) {
+	var repository controllerRepository
+	if err := client.Get("repos/"+controller, &repository); err != nil {
+		return "", false, err
+	}
+	err := client.Get(fmt.Sprintf("repos/%s/branches/%s", controller, url.PathEscape(repository.DefaultBranch)), nil)
+	if err == nil {
+		return repository.DefaultBranch, false, nil
+	}
+	if !isNotFound(err) {
+		return "", false, err
+	}
+	_, name, _ := strings.Cut(controller, "/")
+	readme := fmt.Sprintf("# %s\n\nController repository for Multi-Repository Variant Analysis.\n", name)
+	body, err := jsonBody(map[string]string{
+		"message": "Initialize controller repository",
+		"content": base64.StdEncoding.EncodeToString([]byte(readme)),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if err := client.Put(fmt.Sprintf("repos/%s/contents/README.md", controller), body, nil); err != nil {
+		return "", false, fmt.Errorf("Failed to create the default branch of %s: %v", controller, err)
+	}
+	// the first commit of an empty repository creates its default branch
+	if err := client.Get("repos/"+controller, &repository); err != nil {
+		return "", false, err
+	}
+	return repository.DefaultBranch, true, nil
+}
+
+// EnsureActionsEnabled enables GitHub Actions, which runs the variant
+// analyses, on the controller repository. It reports whether Actions had to be
+// enabled.
+func EnsureActionsEnabled(client api.RESTClient, controller string) (bool, error) {
+	var permissions struct {
+		Enabled bool `json:"enabled"`
+	}
+	path := fmt.Sprintf("repos/%s/actions/permissions", controller)
+	if err := client.Get(path, &permissions); err != nil {
+		return false, err
+	}
+	if permissions.Enabled {
+		return false, nil
+	}
+	body, err := jsonBody(map[string]bool{"enabled": true})
+	if err != nil {
+		return false, err
+	}
+	if err := client.Put(path, body, nil); err != nil {
+		return false, fmt.Errorf("Failed to enable GitHub Actions, enable it in %s: %v", WebURL(controller+"/settings/actions"), err)
+	}
+	return true, nil
+}
+
+func isNotFound(err error) bool {
+	var httpErr api.HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound
+}
+
+func jsonBody(body interface{}) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(body)
+	return &buf, err
+}
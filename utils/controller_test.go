@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cli/go-gh"
+	"github.com/cli/go-gh/pkg/api"
+)
+
+// fakeRepository is a repository of the fake API.
+type fakeRepository struct {
+	defaultBranch  string
+	hasCommit      bool
+	actionsEnabled bool
+}
+
+// fakeAPI serves the endpoints used to set up the controller repository.
+type fakeAPI struct {
+	login        string
+	repositories map[string]*fakeRepository
+	requests     []string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v3/")
+	f.requests = append(f.requests, r.Method+" "+path)
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == "GET" && path == "user":
+		writeJSON(w, map[string]string{"login": f.login})
+	case r.Method == "POST" && (path == "user/repos" || len(parts) == 3 && parts[0] == "orgs" && parts[2] == "repos"):
+		var body struct {
+			Name     string `json:"name"`
+			AutoInit bool   `json:"auto_init"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		owner := f.login
+		if parts[0] == "orgs" {
+			owner = parts[1]
+		}
+		f.repositories[owner+"/"+body.Name] = &fakeRepository{defaultBranch: "main", hasCommit: body.AutoInit, actionsEnabled: true}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]string{"full_name": owner + "/" + body.Name, "default_branch": "main"})
+	case parts[0] == "repos" && len(parts) >= 3:
+		nwo := parts[1] + "/" + parts[2]
+		repository, ok := f.repositories[nwo]
+		if !ok {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+		rest := strings.Join(parts[3:], "/")
+		switch {
+		case r.Method == "GET" && rest == "":
+			writeJSON(w, map[string]string{"full_name": nwo, "default_branch": repository.defaultBranch})
+		case r.Method == "GET" && rest == "branches/"+repository.defaultBranch:
+			if !repository.hasCommit {
+				http.Error(w, `{"message": "Branch not found"}`, http.StatusNotFound)
+				return
+			}
+			writeJSON(w, map[string]string{"name": repository.defaultBranch})
+		case r.Method == "PUT" && rest == "contents/README.md":
+			repository.hasCommit = true
+			w.WriteHeader(http.StatusCreated)
+			writeJSON(w, map[string]string{})
+		case r.Method == "GET" && rest == "actions/permissions":
+			writeJSON(w, map[string]bool{"enabled": repository.actionsEnabled})
+		case r.Method == "PUT" && rest == "actions/permissions":
+			var body struct {
+				Enabled bool `json:"enabled"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			repository.actionsEnabled = body.Enabled
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		}
+	default:
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// newFakeAPIClient returns a client of the fake API, served over TLS as the
+// API of a GitHub Enterprise Server host.
+func newFakeAPIClient(t *testing.T, fake *fakeAPI) api.RESTClient {
+	t.Helper()
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+	client, err := gh.RESTClient(&api.ClientOptions{
+		Host:      strings.TrimPrefix(server.URL, "https://"),
+		AuthToken: "token",
+		Transport: server.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestEnsureControllerRepository(t *testing.T) {
+	tests := []struct {
+		name        string
+		controller  string
+		existing    bool
+		wantCreated bool
+		wantRequest string
+	}{
+		{"existing repository", "octocat/mrva-controller", true, false, ""},
+		{"user repository", "octocat/mrva-controller", false, true, "POST user/repos"},
+		{"user repository with another case", "OctoCat/mrva-controller", false, true, "POST user/repos"},
+		{"organization repository", "octo-org/mrva-controller", false, true, "POST orgs/octo-org/repos"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeAPI{login: "octocat", repositories: map[string]*fakeRepository{}}
+			if tt.existing {
+				fake.repositories[tt.controller] = &fakeRepository{defaultBranch: "main", hasCommit: true}
+			}
+			created, err := EnsureControllerRepository(newFakeAPIClient(t, fake), tt.controller, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created != tt.wantCreated {
+				t.Errorf("created = %v, want %v", created, tt.wantCreated)
+			}
+			posted := ""
+			for _, request := range fake.requests {
+				if strings.HasPrefix(request, "POST ") {
+					posted = request
+				}
+			}
+			if posted != tt.wantRequest {
+				t.Errorf("created the repository with %q, want %q", posted, tt.wantRequest)
+			}
+		})
+	}
+}
+
+func TestEnsureDefaultBranch(t *testing.T) {
+	tests := []struct {
+		name        string
+		hasCommit   bool
+		wantCreated bool
+	}{
+		{"branch with a commit", true, false},
+		{"empty repository", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := &fakeRepository{defaultBranch: "main", hasCommit: tt.hasCommit}
+			fake := &fakeAPI{login: "octocat", repositories: map[string]*fakeRepository{"octocat/mrva-controller": repository}}
+			branch, created, err := EnsureDefaultBranch(newFakeAPIClient(t, fake), "octocat/mrva-controller")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if branch != "main" || created != tt.wantCreated {
+				t.Errorf("EnsureDefaultBranch = %s, %v, want main, %v", branch, created, tt.wantCreated)
+			}
+			if !repository.hasCommit {
+				t.Error("the default branch has no commit")
+			}
+		})
+	}
+}
+
+func TestEnsureActionsEnabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		wantEnabled bool
+	}{
+		{"actions enabled", true, false},
+		{"actions disabled", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := &fakeRepository{defaultBranch: "main", hasCommit: true, actionsEnabled: tt.enabled}
+			fake := &fakeAPI{login: "octocat", repositories: map[string]*fakeRepository{"octocat/mrva-controller": repository}}
+			enabled, err := EnsureActionsEnabled(newFakeAPIClient(t, fake), "octocat/mrva-controller")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enabled != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", enabled, tt.wantEnabled)
+			}
+			if !repository.actionsEnabled {
+				t.Error("GitHub Actions is still disabled")
+			}
+		})
+	}
+}
+
+func TestEnsureControllerRepositoryIsIdempotent(t *testing.T) {
+	fake := &fakeAPI{login: "octocat", repositories: map[string]*fakeRepository{}}
+	client := newFakeAPIClient(t, fake)
+	for i, wantCreated := range []bool{true, false} {
+		created, err := EnsureControllerRepository(client, "octocat/mrva-controller", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != wantCreated {
+			t.Errorf("run %d: created = %v, want %v", i+1, created, wantCreated)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package utils
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/cli/go-gh"
+	"github.com/cli/go-gh/pkg/api"
+	"gopkg.in/yaml.v3"
+)
+
+// ExtractDatabase unzips a downloaded CodeQL database next to the archive and
+// returns the directory containing its codeql-database.yml. Databases that
+// have already been extracted are reused.
+func ExtractDatabase(zipPath string) (string, error) {
+	targetDir := strings.TrimSuffix(zipPath, ".zip")
+	if _, err := os.Stat(targetDir); errors.Is(err, os.ErrNotExist) {
+		err = Unzip(zipPath, targetDir)
+		if err != nil {
+			os.RemoveAll(targetDir)
+			return "", err
+		}
+	}
+	return findDatabaseRoot(targetDir)
+}
+
+func findDatabaseRoot(dir string) (string, error) {
+	root := ""
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if root != "" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == "codeql-database.yml" {
+			root = filepath.Dir(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if root == "" {
+		return "", fmt.Errorf("No CodeQL database found in %s", dir)
+	}
+	return root, nil
+}
+
+// Unzip extracts a zip archive into targetDir, refusing entries that would be
+// written outside of it.
+func Unzip(zipPath string, targetDir string) error {
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+	for _, zf := range zipReader.File {
+		targetPath, err := SafeExtractPath(targetDir, zf.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", zipPath, err)
+		}
+		if zf.FileInfo().IsDir() {
+			err = os.MkdirAll(targetPath, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+		if err != nil {
+			return err
+		}
+		err = unzipFile(zf, targetPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SafeExtractPath returns the path a zip entry is extracted to, rejecting
+// entries that would be written outside of targetDir.
+func SafeExtractPath(targetDir string, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("Illegal file path in archive: %s", name)
+	}
+	targetPath := filepath.Join(targetDir, name)
+	if !strings.HasPrefix(targetPath, filepath.Clean(targetDir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Illegal file path in archive: %s", name)
+	}
+	return targetPath, nil
+}
+
+func unzipFile(zf *zip.File, targetPath string) error {
+	f, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// keep the executable bits, needed by the CodeQL CLI archives
+	out, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, zf.Mode().Perm()|0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, f)
+	return err
+}
+
+// AnalyzeDatabase runs a query against a local database and writes the
+// results as SARIF to outputPath.
+func AnalyzeDatabase(dbPath string, queryFile string, additionalPacks string, outputPath string) error {
+	args := []string{"database", "analyze", "--format=sarif-latest", "--output=" + outputPath, "--rerun", "--sarif-add-snippets", dbPath, queryFile}
+	stdouterr, err := RunCodeQLCommand(additionalPacks, true, args...)
+	if err != nil {
+		return fmt.Errorf("`codeql database analyze` failed for %s: %v\n%s", dbPath, err, string(stdouterr))
+	}
+	return nil
+}
+
+var databaseCacheDir string
+
+func GetDatabaseCacheDir() string {
+	return databaseCacheDir
+}
+
+func SetDatabaseCacheDir(path string) {
+	databaseCacheDir = path
+}
+
+// GetDatabaseMetadata returns the metadata of the latest CodeQL database of a
+// repository for the given language.
+func GetDatabaseMetadata(nwo string, language string) (map[string]interface{}, error) {
+	opts := api.ClientOptions{
+		Host:      GetHost(),
+		Headers:   map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Transport: DownloadTransport(),
+	}
+	client, err := gh.RESTClient(&opts)
+	if err != nil {
+		return nil, err
+	}
+	response := make(map[string]interface{})
+	err = client.Get(fmt.Sprintf("repos/%s/code-scanning/codeql/databases/%s", nwo, language), &response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func cachedDatabaseBasePath(nwo string, language string, commitSha string) string {
+	return filepath.Join(databaseCacheDir, filepath.FromSlash(nwo), language, commitSha)
+}
+
+// CacheDatabase makes sure the latest database of a repository is in the
+// database cache, downloading it only if the commit it was built from is not
+// cached yet.
+func CacheDatabase(nwo string, language string) (models.CachedDatabase, error) {
+	metadata, err := GetDatabaseMetadata(nwo, language)
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	return CacheDatabaseWithMetadata(nwo, language, metadata)
+}
+
+// databaseCacheKey returns the key of a database in the cache: the commit it
+// was built from.
+func databaseCacheKey(metadata map[string]interface{}) string {
+	commitSha, _ := metadata["commit_oid"].(string)
+	if commitSha == "" {
+		// databases uploaded without commit information are keyed by their id
+		id, _ := metadata["id"].(float64)
+		commitSha = fmt.Sprintf("id-%d", int(id))
+	}
+	return commitSha
+}
+
+func lookupCachedDatabase(basePath string) (models.CachedDatabase, bool) {
+	cachedDatabase, err := readCachedDatabase(basePath + ".json")
+	if err != nil {
+		return cachedDatabase, false
+	}
+	if _, err := os.Stat(cachedDatabase.Path); err != nil {
+		return cachedDatabase, false
+	}
+	return cachedDatabase, true
+}
+
+// IsDatabaseCached reports whether the database described by metadata is
+// already in the database cache, so that it will not be downloaded.
+func IsDatabaseCached(nwo string, language string, metadata map[string]interface{}) bool {
+	_, ok := lookupCachedDatabase(cachedDatabaseBasePath(nwo, language, databaseCacheKey(metadata)))
+	return ok
+}
+
+var (
+	databaseLocksLock sync.Mutex
+	databaseLocks     = make(map[string]*sync.Mutex)
+)
+
+// lockDatabase serializes the downloads of the database of a repository, so
+// that runs sharing a repository download its database only once.
+func lockDatabase(nwo string, language string) func() {
+	databaseLocksLock.Lock()
+	key := nwo + "/" + language
+	lock, ok := databaseLocks[key]
+	if !ok {
+		lock = new(sync.Mutex)
+		databaseLocks[key] = lock
+	}
+	databaseLocksLock.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// CacheDatabaseWithMetadata is like CacheDatabase for callers that already
+// fetched the database metadata.
+func CacheDatabaseWithMetadata(nwo string, language string, metadata map[string]interface{}) (models.CachedDatabase, error) {
+	defer lockDatabase(nwo, language)()
+	commitSha := databaseCacheKey(metadata)
+	basePath := cachedDatabaseBasePath(nwo, language, commitSha)
+	if cachedDatabase, ok := lookupCachedDatabase(basePath); ok {
+		return cachedDatabase, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(basePath), 0755)
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	size, sha256sum, err := downloadDatabaseTo(nwo, language, basePath+".zip")
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	metadataCommitSha := commitSha
+	// a newer database may have been uploaded after the metadata was fetched,
+	// so the download is keyed by the commit it was actually built from
+	if _, ok := metadata["commit_oid"].(string); ok {
+		if downloadedCommitSha := databaseCommitSha(basePath + ".zip"); downloadedCommitSha != "" && downloadedCommitSha != commitSha {
+			downloadedBasePath := cachedDatabaseBasePath(nwo, language, downloadedCommitSha)
+			err = os.Rename(basePath+".zip", downloadedBasePath+".zip")
+			if err != nil {
+				return models.CachedDatabase{}, err
+			}
+			commitSha, basePath = downloadedCommitSha, downloadedBasePath
+		}
+	}
+	cachedDatabase := models.CachedDatabase{
+		Nwo:          nwo,
+		Language:     language,
+		CommitSha:    commitSha,
+		Size:         size,
+		DownloadedAt: time.Now(),
+		Path:         basePath + ".zip",
+		Sha256:       sha256sum,
+	}
+	if createdAt, ok := metadata["created_at"].(string); ok && commitSha == metadataCommitSha {
+		cachedDatabase.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	}
+	data, err := json.MarshalIndent(cachedDatabase, "", "  ")
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	// write the metadata atomically, it is what marks the database as cached
+	tmpFile, err := os.CreateTemp(filepath.Dir(basePath), filepath.Base(basePath)+".json.*.tmp")
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	err = os.Chmod(tmpFile.Name(), 0644)
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	err = os.Rename(tmpFile.Name(), basePath+".json")
+	if err != nil {
+		return models.CachedDatabase{}, err
+	}
+	return cachedDatabase, nil
+}
+
+// databaseCommitSha returns the commit a zipped database was built from, as
+// recorded in its codeql-database.yml, or an empty string if it is unknown.
+func databaseCommitSha(zipPath string) string {
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return ""
+	}
+	defer zipReader.Close()
+	for _, zf := range zipReader.File {
+		if path.Base(zf.Name) != "codeql-database.yml" || strings.Count(zf.Name, "/") > 1 {
+			continue
+		}
+		content, err := readZipEntry(zf, 1<<20)
+		if err != nil {
+			return ""
+		}
+		var database struct {
+			CreationMetadata struct {
+				Sha string `yaml:"sha"`
+			} `yaml:"creationMetadata"`
+		}
+		if yaml.Unmarshal(content, &database) != nil {
+			return ""
+		}
+		return database.CreationMetadata.Sha
+	}
+	return ""
+}
+
+func downloadDatabaseTo(nwo string, language string, targetPath string) (int64, string, error) {
+	opts := api.ClientOptions{
+		Host:      GetHost(),
+		Headers:   map[string]string{"Accept": "application/zip"},
+		Transport: DownloadTransport(),
+	}
+	client, err := gh.HTTPClient(&opts)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := client.Get(RESTURL(fmt.Sprintf("repos/%s/code-scanning/codeql/databases/%s", nwo, language)))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("Failed to download database for %s: %s", nwo, resp.Status)
+	}
+
+	// download to a temporary file so that interrupted downloads never end up in the cache
+	tmpFile, err := os.CreateTemp(filepath.Dir(targetPath), filepath.Base(targetPath)+".*.tmp")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	hash := sha256.New()
+	transfer := StartTransfer(nwo+" "+language+" database", resp.ContentLength)
+	defer transfer.Finish()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), transfer.Reader(resp.Body))
+	tmpFile.Close()
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), os.Rename(tmpFile.Name(), targetPath)
+}
+
+func readCachedDatabase(metadataPath string) (models.CachedDatabase, error) {
+	var cachedDatabase models.CachedDatabase
+	data, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return cachedDatabase, err
+	}
+	err = json.Unmarshal(data, &cachedDatabase)
+	if err != nil {
+		return cachedDatabase, err
+	}
+	extracted := strings.TrimSuffix(metadataPath, ".json")
+	if _, err := os.Stat(extracted); err == nil {
+		cachedDatabase.Extracted = extracted
+	}
+	return cachedDatabase, nil
+}
+
+// ListCachedDatabases returns every database in the database cache.
+func ListCachedDatabases() ([]models.CachedDatabase, error) {
+	var cachedDatabases []models.CachedDatabase
+	if _, err := os.Stat(databaseCacheDir); errors.Is(err, os.ErrNotExist) {
+		return cachedDatabases, nil
+	}
+	err := filepath.WalkDir(databaseCacheDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != databaseCacheDir {
+			// skip extracted databases
+			if _, err := os.Stat(path + ".json"); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		cachedDatabase, err := readCachedDatabase(path)
+		if err != nil {
+			return nil
+		}
+		cachedDatabases = append(cachedDatabases, cachedDatabase)
+		return nil
+	})
+	return cachedDatabases, err
+}
+
+// RemoveCachedDatabase deletes a database, its metadata and its extracted copy
+// from the database cache.
+func RemoveCachedDatabase(cachedDatabase models.CachedDatabase) error {
+	basePath := strings.TrimSuffix(cachedDatabase.Path, ".zip")
+	for _, path := range []string{basePath, basePath + ".zip", basePath + ".json"} {
+		err := os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResolveDatabase validates an extracted database with `codeql resolve database`.
+func ResolveDatabase(dbPath string) error {
+	stdouterr, err := RunCodeQLCommand("", true, "resolve", "database", dbPath)
+	if err != nil {
+		return fmt.Errorf("`codeql resolve database` failed for %s: %v\n%s", dbPath, err, string(stdouterr))
+	}
+	return nil
+}
+
+// LinkFile makes srcPath available at targetPath, preferring a hard link and
+// falling back to a symbolic link or a copy.
+func LinkFile(srcPath string, targetPath string) error {
+	os.Remove(targetPath)
+	if err := os.Link(srcPath, targetPath); err == nil {
+		return nil
+	}
+	absPath, err := filepath.Abs(srcPath)
+	if err == nil {
+		if err := os.Symlink(absPath, targetPath); err == nil {
+			return nil
+		}
+	}
+	return CopyFile(srcPath, targetPath)
+}
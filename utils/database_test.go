@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatabaseCommitSha(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"database in a directory", map[string]string{"java/codeql-database.yml": "creationMetadata:\n  sha: abc123\n"}, "abc123"},
+		{"database at the root", map[string]string{"codeql-database.yml": "creationMetadata:\n  sha: def456\n"}, "def456"},
+		{"no creation metadata", map[string]string{"java/codeql-database.yml": "primaryLanguage: java\n"}, ""},
+		{"no database", map[string]string{"java/src.zip": ""}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zipPath := filepath.Join(t.TempDir(), "db.zip")
+			f, err := os.Create(zipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zipWriter := zip.NewWriter(f)
+			for name, content := range tt.files {
+				w, err := zipWriter.Create(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Write([]byte(content))
+			}
+			zipWriter.Close()
+			f.Close()
+			if got := databaseCommitSha(zipPath); got != tt.want {
+				t.Errorf("databaseCommitSha = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+const (
+	// file recording the selected distribution in the distributions directory
+	selectedDistributionFile = "selected"
+	distributionMetadataFile = "distribution.json"
+)
+
+var codeqlDistributionsDir string
+
+func GetCodeQLDistributionsDir() string {
+	return codeqlDistributionsDir
+}
+
+func SetCodeQLDistributionsDir(path string) {
+	codeqlDistributionsDir = path
+}
+
+// CodeQLPlatform returns the platform name used by the CodeQL CLI archives.
+func CodeQLPlatform() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "osx64"
+	case "windows":
+		return "win64"
+	}
+	return "linux64"
+}
+
+// ResolveCodeQLMirror returns the URL template of the CodeQL CLI archives from
+// the codeql_mirror config option or the default.
+func ResolveCodeQLMirror() string {
+	if configData, err := GetConfig(); err == nil && configData.CodeQLMirror != "" {
+		return configData.CodeQLMirror
+	}
+	return config.CODEQL_DOWNLOAD_URL
+}
+
+// CodeQLArchiveURL renders a mirror URL template for a version.
+func CodeQLArchiveURL(mirror string, version string) (string, error) {
+	tmpl, err := template.New("mirror").Option("missingkey=error").Parse(mirror)
+	if err != nil {
+		return "", fmt.Errorf("Invalid CodeQL mirror %q: %v", mirror, err)
+	}
+	var url bytes.Buffer
+	err = tmpl.Execute(&url, map[string]string{
+		"Version":  strings.TrimPrefix(version, "v"),
+		"Platform": CodeQLPlatform(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Invalid CodeQL mirror %q: %v", mirror, err)
+	}
+	return url.String(), nil
+}
+
+// InstallCodeQLDistribution installs the CodeQL CLI archive found at source,
+// a local path or a URL, as the given version. The archive must match
+// checksum or, if it is empty, the checksum published next to it in a
+// .checksum.txt file.
+func InstallCodeQLDistribution(version string, source string, checksum string) (models.CodeQLDistribution, error) {
+	version = strings.TrimPrefix(version, "v")
+	targetDir := filepath.Join(codeqlDistributionsDir, version)
+	if _, err := os.Stat(filepath.Join(targetDir, distributionMetadataFile)); err == nil {
+		return models.CodeQLDistribution{}, fmt.Errorf("CodeQL %s is already installed", version)
+	}
+	err := os.MkdirAll(codeqlDistributionsDir, 0755)
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+
+	archivePath := source
+	if IsURL(source) {
+		tmpFile, err := os.CreateTemp(codeqlDistributionsDir, "codeql-*"+archiveExtension(source))
+		if err != nil {
+			return models.CodeQLDistribution{}, err
+		}
+		tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+		err = downloadFile(source, tmpFile.Name())
+		if err != nil {
+			return models.CodeQLDistribution{}, err
+		}
+		archivePath = tmpFile.Name()
+	}
+	if checksum == "" {
+		checksum, err = readPublishedChecksum(source)
+		if err != nil {
+			return models.CodeQLDistribution{}, fmt.Errorf("No checksum found for %s, use --sha256 to provide one: %v", source, err)
+		}
+	}
+	sha256sum, err := Sha256File(archivePath)
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+	if !strings.EqualFold(sha256sum, checksum) {
+		return models.CodeQLDistribution{}, fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", source, checksum, sha256sum)
+	}
+
+	// extract to a temporary directory so that failed installs leave nothing behind
+	extractDir, err := os.MkdirTemp(codeqlDistributionsDir, version+".*.tmp")
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+	defer os.RemoveAll(extractDir)
+	if strings.HasSuffix(archivePath, ".tar.gz") || strings.HasSuffix(archivePath, ".tgz") {
+		err = untarGz(archivePath, extractDir)
+	} else {
+		err = Unzip(archivePath, extractDir)
+	}
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+	// archives contain a single codeql directory
+	binary := FindCodeQLBinary(filepath.Join(extractDir, "codeql"))
+	if binary == "" {
+		return models.CodeQLDistribution{}, fmt.Errorf("%s is not a CodeQL CLI archive", source)
+	}
+	detectedVersion, err := detectCodeQLVersion(binary)
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+	if CompareVersions(detectedVersion, version) != 0 {
+		return models.CodeQLDistribution{}, fmt.Errorf("%s contains CodeQL %s, not %s", source, detectedVersion, version)
+	}
+
+	distribution := models.CodeQLDistribution{
+		Version:     version,
+		Source:      redactedSource(source),
+		Sha256:      sha256sum,
+		InstalledAt: time.Now(),
+	}
+	data, err := json.MarshalIndent(distribution, "", "  ")
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+	err = os.WriteFile(filepath.Join(extractDir, distributionMetadataFile), data, 0644)
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+	os.RemoveAll(targetDir)
+	err = os.Rename(extractDir, targetDir)
+	if err != nil {
+		return models.CodeQLDistribution{}, err
+	}
+	distribution.Path = FindCodeQLBinary(filepath.Join(targetDir, "codeql"))
+	return distribution, nil
+}
+
+// ListCodeQLDistributions returns the installed distributions, newest first.
+func ListCodeQLDistributions() ([]models.CodeQLDistribution, error) {
+	entries, err := os.ReadDir(codeqlDistributionsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	selected := GetSelectedCodeQLVersion()
+	var distributions []models.CodeQLDistribution
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		distribution, err := readCodeQLDistribution(entry.Name())
+		if err != nil {
+			continue
+		}
+		distribution.Selected = distribution.Version == selected
+		distributions = append(distributions, distribution)
+	}
+	sort.SliceStable(distributions, func(i, j int) bool {
+		return CompareVersions(distributions[i].Version, distributions[j].Version) > 0
+	})
+	return distributions, nil
+}
+
+func readCodeQLDistribution(version string) (models.CodeQLDistribution, error) {
+	var distribution models.CodeQLDistribution
+	dir := filepath.Join(codeqlDistributionsDir, version)
+	data, err := os.ReadFile(filepath.Join(dir, distributionMetadataFile))
+	if err != nil {
+		return distribution, err
+	}
+	err = json.Unmarshal(data, &distribution)
+	if err != nil {
+		return distribution, err
+	}
+	distribution.Path = FindCodeQLBinary(filepath.Join(dir, "codeql"))
+	if distribution.Path == "" {
+		return distribution, fmt.Errorf("CodeQL %s is not installed correctly", version)
+	}
+	return distribution, nil
+}
+
+// GetCodeQLDistribution returns an installed distribution.
+func GetCodeQLDistribution(version string) (models.CodeQLDistribution, error) {
+	version = strings.TrimPrefix(version, "v")
+	distribution, err := readCodeQLDistribution(version)
+	if errors.Is(err, os.ErrNotExist) {
+		return distribution, fmt.Errorf("CodeQL %s is not installed, use 'gh mrva codeql install %s'", version, version)
+	}
+	return distribution, err
+}
+
+// GetSelectedCodeQLVersion returns the version selected with 'codeql use', if
+// any.
+func GetSelectedCodeQLVersion() string {
+	data, err := os.ReadFile(filepath.Join(codeqlDistributionsDir, selectedDistributionFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SelectCodeQLDistribution makes an installed distribution the default CLI.
+// An empty version goes back to the CLI found in PATH.
+func SelectCodeQLDistribution(version string) error {
+	selectedPath := filepath.Join(codeqlDistributionsDir, selectedDistributionFile)
+	if version == "" {
+		err := os.Remove(selectedPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	distribution, err := GetCodeQLDistribution(version)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(selectedPath, []byte(distribution.Version+"\n"), 0644)
+}
+
+// IsURL reports whether an archive source is a URL rather than a local path.
+func IsURL(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+func archiveExtension(source string) string {
+	if strings.HasSuffix(source, ".tar.gz") {
+		return ".tar.gz"
+	}
+	if strings.HasSuffix(source, ".tgz") {
+		return ".tgz"
+	}
+	return ".zip"
+}
+
+// redactedSource drops the query of a URL, which may hold credentials of the
+// mirror, before it is recorded.
+func redactedSource(source string) string {
+	if i := strings.Index(source, "?"); IsURL(source) && i >= 0 {
+		return source[:i]
+	}
+	return source
+}
+
+func downloadFile(url string, targetPath string) error {
+	client := http.Client{Transport: APITransport()}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to download %s: %s", redactedSource(url), resp.Status)
+	}
+	out, err := os.Create(targetPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	transfer := StartTransfer(filepath.Base(redactedSource(url)), resp.ContentLength)
+	defer transfer.Finish()
+	_, err = io.Copy(out, transfer.Reader(resp.Body))
+	return err
+}
+
+// readPublishedChecksum reads the SHA-256 checksum published next to an
+// archive, as done for the CodeQL CLI releases.
+func readPublishedChecksum(source string) (string, error) {
+	var content []byte
+	if IsURL(source) {
+		checksumURL := source + ".checksum.txt"
+		if i := strings.Index(source, "?"); i >= 0 {
+			checksumURL = source[:i] + ".checksum.txt" + source[i:]
+		}
+		client := http.Client{Transport: APITransport()}
+		resp, err := client.Get(checksumURL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", errors.New(resp.Status)
+		}
+		content, err = io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		content, err = os.ReadFile(source + ".checksum.txt")
+		if err != nil {
+			return "", err
+		}
+	}
+	// the checksum is the first field, optionally followed by the file name
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return "", errors.New("empty checksum file")
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum %q", fields[0])
+	}
+	return fields[0], nil
+}
+
+// untarGz extracts a .tar.gz archive into targetDir, refusing entries that
+// would be written outside of it.
+func untarGz(archivePath string, targetDir string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+		targetPath, err := SafeExtractPath(targetDir, name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", archivePath, err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(targetPath, 0755)
+		case tar.TypeReg:
+			err = extractTarFile(tarReader, targetPath, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			// the link must not point outside of the distribution either
+			if filepath.IsAbs(header.Linkname) {
+				return fmt.Errorf("%s: Illegal link target in archive: %s -> %s", archivePath, name, header.Linkname)
+			}
+			_, err = SafeExtractPath(targetDir, filepath.Join(filepath.Dir(name), header.Linkname))
+			if err != nil {
+				return fmt.Errorf("%s: Illegal link target in archive: %s -> %s", archivePath, name, header.Linkname)
+			}
+			err = extractTarSymlink(header.Linkname, targetPath)
+		default:
+			// hard links and special files are not needed to run the CLI
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractTarSymlink(linkname string, targetPath string) error {
+	err := os.MkdirAll(filepath.Dir(targetPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(linkname, targetPath)
+}
+
+func extractTarFile(r io.Reader, targetPath string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(targetPath), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	return err
+}
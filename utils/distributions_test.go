@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUntarGzSymlink(t *testing.T) {
+	tests := []struct {
+		name     string
+		link     string
+		linkname string
+		wantErr  bool
+	}{
+		{"link in the same directory", "codeql/tools/java", "java-21", false},
+		{"link to a parent directory", "codeql/tools/linux64/java", "../java-21", false},
+		{"link outside of the distribution", "codeql/tools/java", "../../../etc", true},
+		{"absolute link", "codeql/tools/java", "/etc", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "codeql.tar.gz")
+			f, err := os.Create(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gzipWriter := gzip.NewWriter(f)
+			tarWriter := tar.NewWriter(gzipWriter)
+			tarWriter.WriteHeader(&tar.Header{Name: "codeql/codeql", Typeflag: tar.TypeReg, Mode: 0755, Size: 2})
+			tarWriter.Write([]byte("#!"))
+			tarWriter.WriteHeader(&tar.Header{Name: tt.link, Typeflag: tar.TypeSymlink, Linkname: tt.linkname})
+			tarWriter.Close()
+			gzipWriter.Close()
+			f.Close()
+
+			targetDir := t.TempDir()
+			err = untarGz(archivePath, targetDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("untarGz error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := os.Readlink(filepath.Join(targetDir, tt.link))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.linkname {
+				t.Errorf("link target = %q, want %q", got, tt.linkname)
+			}
+		})
+	}
+}
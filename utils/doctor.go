@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"github.com/cli/go-gh/pkg/api"
+	"github.com/cli/go-gh/pkg/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// outcomes of the doctor checks
+const (
+	DoctorPass = "pass"
+	DoctorWarn = "warn"
+	DoctorFail = "fail"
+)
+
+func doctorCheck(name string, status string, message string, hint string) models.DoctorCheck {
+	return models.DoctorCheck{Name: name, Status: status, Message: message, Hint: hint}
+}
+
+// CheckConfigFiles validates the config files and the GH_MRVA_* environment
+// variables.
+func CheckConfigFiles() models.DoctorCheck {
+	var errs []error
+	if _, err := os.Stat(configFilePath); err == nil {
+		errs = append(errs, ValidateConfigFile(configFilePath)...)
+	}
+	if projectFile := FindProjectConfigFile(); projectFile != "" {
+		errs = append(errs, ValidateConfigFile(projectFile)...)
+	}
+	errs = append(errs, ValidateConfigEnv()...)
+	if len(errs) > 0 {
+		return doctorCheck("config", DoctorFail, errors.Join(errs...).Error(), "Fix the options reported above, 'gh mrva config validate' checks them again")
+	}
+	return doctorCheck("config", DoctorPass, "The config files are valid", "")
+}
+
+// CheckCodeQLCLI checks that the CodeQL CLI can be found and supports the
+// options used to bundle query packs. It selects the CLI it finds.
+func CheckCodeQLCLI(flagValue string) models.DoctorCheck {
+	cli, err := ResolveCodeQLCLI(flagValue)
+	if err != nil {
+		return doctorCheck("codeql", DoctorFail, err.Error(), "Fix --codeql-cli or codeql_cli, or select another distribution with 'gh mrva codeql use'")
+	}
+	SetCodeQLCLI(cli)
+	version, err := CheckCodeQLVersion("")
+	if version == "" {
+		return doctorCheck("codeql", DoctorFail, err.Error(), "Add codeql to PATH or install it with 'gh mrva codeql install <version>'")
+	}
+	if err != nil {
+		return doctorCheck("codeql", DoctorFail, err.Error(), "Install a newer CLI with 'gh mrva codeql install <version>' and select it with 'gh mrva codeql use <version>'")
+	}
+	return doctorCheck("codeql", DoctorPass, fmt.Sprintf("CodeQL CLI %s (%s)", version, cli), "")
+}
+
+// CheckCodeQLLibraries checks that codeql_path, if set, points to a checkout
+// of the CodeQL libraries.
+func CheckCodeQLLibraries() models.DoctorCheck {
+	path := ResolveCodeQLLibraries("")
+	if path == "" {
+		return doctorCheck("codeql-libraries", DoctorPass, "codeql_path is not set, the query dependencies are resolved from the CodeQL package registry", "")
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return doctorCheck("codeql-libraries", DoctorFail, fmt.Sprintf("codeql_path %s is not a directory", path), "Point codeql_path to a checkout of https://github.com/github/codeql")
+	}
+	return doctorCheck("codeql-libraries", DoctorPass, "CodeQL libraries in "+path, "")
+}
+
+// CheckAuth checks that gh has a token for the selected host.
+func CheckAuth() models.DoctorCheck {
+	host := GetHost()
+	token, source := auth.TokenForHost(host)
+	if token == "" {
+		return doctorCheck("auth", DoctorFail, "Not logged in to "+host, "Run 'gh auth login --hostname "+host+"'")
+	}
+	return doctorCheck("auth", DoctorPass, fmt.Sprintf("Logged in to %s (token from %s)", host, source), "")
+}
+
+// CheckAPI checks that the API of the selected host can be reached and that
+// the token has the scopes needed to submit variant analyses.
+func CheckAPI(client api.RESTClient) models.DoctorCheck {
+	host := GetHost()
+	resp, err := client.Request("GET", "user", nil)
+	if err != nil {
+		return doctorCheck("api", DoctorFail, fmt.Sprintf("Cannot reach the API of %s: %v", host, err), "Check the network, --hostname or GH_HOST, and 'gh auth status'")
+	}
+	resp.Body.Close()
+	header := resp.Header.Get("X-OAuth-Scopes")
+	if header == "" {
+		return doctorCheck("api", DoctorWarn, "The API of "+host+" is reachable, but the scopes of the token cannot be checked", "Fine-grained tokens need read and write access to Actions and contents of the controller repository")
+	}
+	scopes := map[string]bool{}
+	for _, scope := range strings.Split(header, ",") {
+		scopes[strings.TrimSpace(scope)] = true
+	}
+	if scopes["repo"] {
+		return doctorCheck("api", DoctorPass, "The API of "+host+" is reachable, token scopes: "+header, "")
+	}
+	hint := "Run 'gh auth refresh --hostname " + host + " --scopes repo'"
+	if scopes["public_repo"] {
+		return doctorCheck("api", DoctorWarn, "The token only has the public_repo scope, private controller and target repositories cannot be used", hint)
+	}
+	return doctorCheck("api", DoctorFail, "The token is missing the repo scope, token scopes: "+header, hint)
+}
+
+// CheckController checks that the controller repository exists, can be written
+// to, has a default branch with a commit and has GitHub Actions enabled.
+func CheckController(client api.RESTClient, controller string) []models.DoctorCheck {
+	if controller == "" {
+		return []models.DoctorCheck{doctorCheck("controller", DoctorFail, "No controller configured", "Run 'gh mrva init' or set the controller option")}
+	}
+	var repository struct {
+		DefaultBranch string `json:"default_branch"`
+		Permissions   struct {
+			Push bool `json:"push"`
+		} `json:"permissions"`
+	}
+	if err := client.Get("repos/"+controller, &repository); err != nil {
+		if isNotFound(err) {
+			return []models.DoctorCheck{doctorCheck("controller", DoctorFail, fmt.Sprintf("Controller repository %s not found", controller), "Run 'gh mrva init' to create it")}
+		}
+		return []models.DoctorCheck{doctorCheck("controller", DoctorFail, fmt.Sprintf("Cannot get the controller repository %s: %v", controller, err), "")}
+	}
+	if !repository.Permissions.Push {
+		return []models.DoctorCheck{doctorCheck("controller", DoctorFail, fmt.Sprintf("No write access to the controller repository %s", controller), "Ask for write access or use a controller repository of your own")}
+	}
+	checks := []models.DoctorCheck{}
+	err := client.Get(fmt.Sprintf("repos/%s/branches/%s", controller, repository.DefaultBranch), nil)
+	switch {
+	case isNotFound(err):
+		checks = append(checks, doctorCheck("controller", DoctorFail, fmt.Sprintf("The controller repository %s has no commit on its default branch %s", controller, repository.DefaultBranch), "Run 'gh mrva init' to add one"))
+	case err != nil:
+		checks = append(checks, doctorCheck("controller", DoctorFail, fmt.Sprintf("Cannot get the default branch of %s: %v", controller, err), ""))
+	default:
+		checks = append(checks, doctorCheck("controller", DoctorPass, fmt.Sprintf("Controller repository %s, default branch %s", controller, repository.DefaultBranch), ""))
+	}
+
+	var permissions struct {
+		Enabled bool `json:"enabled"`
+	}
+	settings := WebURL(controller + "/settings/actions")
+	if err := client.Get(fmt.Sprintf("repos/%s/actions/permissions", controller), &permissions); err != nil {
+		checks = append(checks, doctorCheck("actions", DoctorWarn, "Cannot check whether GitHub Actions is enabled, it requires admin access to the controller repository", "Check "+settings))
+	} else if !permissions.Enabled {
+		checks = append(checks, doctorCheck("actions", DoctorFail, "GitHub Actions is disabled on "+controller, "Enable it in "+settings+" or run 'gh mrva init'"))
+	} else {
+		checks = append(checks, doctorCheck("actions", DoctorPass, "GitHub Actions is enabled on "+controller, ""))
+	}
+	return checks
+}
+
+// CheckListFile checks that the repository list file can be read and that its
+// lists hold repositories in the owner/name form.
+func CheckListFile(listFile string) models.DoctorCheck {
+	if listFile == "" {
+		return doctorCheck("list-file", DoctorWarn, "No list_file configured, submit needs --list-file", "Set the list_file option or run 'gh mrva init'")
+	}
+	content, err := os.ReadFile(listFile)
+	if err != nil {
+		return doctorCheck("list-file", DoctorFail, fmt.Sprintf("Cannot read the list file: %v", err), "Fix the list_file option or run 'gh mrva init' to create it")
+	}
+	var repoLists map[string][]string
+	if err := json.Unmarshal(content, &repoLists); err != nil {
+		return doctorCheck("list-file", DoctorFail, fmt.Sprintf("%s is not a valid list file: %v", listFile, err), `The list file maps list names to repositories: {"my-list": ["owner/repo"]}`)
+	}
+	var warnings []string
+	count := 0
+	for name, repositories := range repoLists {
+		count += len(repositories)
+		for _, repository := range repositories {
+			if parts := strings.Split(repository, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return doctorCheck("list-file", DoctorFail, fmt.Sprintf("List '%s' in %s holds %q, which is not a repository", name, listFile, repository), "Use the owner/name form")
+			}
+		}
+		if len(repositories) > config.MAX_MRVA_REPOSITORIES {
+			runs := (len(repositories) + config.MAX_MRVA_REPOSITORIES - 1) / config.MAX_MRVA_REPOSITORIES
+			warnings = append(warnings, fmt.Sprintf("list '%s' has %d repositories, more than the %d of a variant analysis, it is submitted as %d runs per query", name, len(repositories), config.MAX_MRVA_REPOSITORIES, runs))
+		}
+		if len(repositories) == 0 {
+			warnings = append(warnings, fmt.Sprintf("list '%s' is empty", name))
+		}
+	}
+	if len(warnings) > 0 {
+		return doctorCheck("list-file", DoctorWarn, listFile+": "+strings.Join(warnings, "; "), "")
+	}
+	return doctorCheck("list-file", DoctorPass, fmt.Sprintf("%s: %d lists, %d repositories", listFile, len(repoLists), count), "")
+}
+
+// CheckSessionsFile checks that the sessions file can be parsed.
+func CheckSessionsFile() models.DoctorCheck {
+	content, err := os.ReadFile(sessionsFilePath)
+	if err != nil {
+		return doctorCheck("sessions", DoctorFail, fmt.Sprintf("Cannot read %s: %v", sessionsFilePath, err), "")
+	}
+	var sessions map[string]models.Session
+	if err := yaml.Unmarshal(content, &sessions); err != nil {
+		return doctorCheck("sessions", DoctorFail, fmt.Sprintf("%s is corrupt: %v", sessionsFilePath, err), "Fix the file or move it aside, the commands working on sessions fail until then")
+	}
+	return doctorCheck("sessions", DoctorPass, fmt.Sprintf("%d sessions in %s", len(sessions), sessionsFilePath), "")
+}
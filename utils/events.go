@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+const (
+	TextOutput      = "text"
+	JSONLinesOutput = "json-lines"
+)
+
+// Types of the events emitted with --output json-lines.
+const (
+	PackCompiledEvent       = "pack_compiled"
+	RunSubmittedEvent       = "run_submitted"
+	SessionSavedEvent       = "session_saved"
+	StatusPolledEvent       = "status_polled"
+	ArtifactDownloadedEvent = "artifact_downloaded"
+	DatabaseDownloadedEvent = "database_downloaded"
+	DatabaseAnalyzedEvent   = "database_analyzed"
+	DatabaseRemovedEvent    = "database_removed"
+	DatabaseExtractedEvent  = "database_extracted"
+	SessionDeletedEvent     = "session_deleted"
+	ConfigSetEvent          = "config_set"
+	SetupStepEvent          = "setup_step"
+	DoctorCheckEvent        = "doctor_check"
+	CodeQLInstalledEvent    = "codeql_installed"
+	CodeQLSelectedEvent     = "codeql_selected"
+	RunInProgressEvent      = "run_in_progress"
+	// the data a command lists or reports, such as sessions or statuses
+	ResultEvent = "result"
+	ErrorEvent  = "error"
+)
+
+var (
+	eventLock   sync.Mutex
+	eventOutput io.Writer
+	textOutput  io.Writer = os.Stdout
+)
+
+// SetOutputFormat selects between the human readable output and the JSON
+// event stream. In json-lines mode stdout only carries events, and the human
+// readable messages written with Out are sent to stderr instead.
+func SetOutputFormat(format string) error {
+	switch format {
+	case "", TextOutput:
+		return nil
+	case JSONLinesOutput:
+		eventLock.Lock()
+		eventOutput = os.Stdout
+		textOutput = os.Stderr
+		eventLock.Unlock()
+		log.SetFlags(0)
+		log.SetOutput(eventLogWriter{})
+		return nil
+	}
+	return fmt.Errorf("Invalid output format '%s'. Valid formats are text and json-lines", format)
+}
+
+// JSONOutput reports whether events are being emitted.
+func JSONOutput() bool {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	return eventOutput != nil
+}
+
+// Out returns the writer of the human readable output: stdout, or stderr when
+// stdout carries the JSON event stream.
+func Out() io.Writer {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	return textOutput
+}
+
+// Printf writes a human readable message to Out.
+func Printf(format string, a ...interface{}) {
+	fmt.Fprintf(Out(), format, a...)
+}
+
+// Println writes a human readable message to Out.
+func Println(a ...interface{}) {
+	fmt.Fprintln(Out(), a...)
+}
+
+// Print writes a human readable message to Out.
+func Print(a ...interface{}) {
+	fmt.Fprint(Out(), a...)
+}
+
+// PrintJSON writes the data a command lists or reports, as indented JSON on
+// stdout or, in json-lines mode, as a result event.
+func PrintJSON(data interface{}) error {
+	if JSONOutput() {
+		EmitEvent(models.Event{Type: ResultEvent, Data: data})
+		return nil
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// Fatalf reports an error stopping the command, as an error event and on
+// stderr, and exits with status 1.
+func Fatalf(format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	EmitEvent(models.Event{Type: ErrorEvent, Error: message})
+	fmt.Fprintln(os.Stderr, message)
+	CloseLogFile()
+	os.Exit(1)
+}
+
+// IsInteractive reports whether output is meant for a human at a terminal.
+func IsInteractive() bool {
+	return !JSONOutput() && IsTerminal()
+}
+
+// EmitEvent writes an event as a single JSON line. It does nothing unless the
+// json-lines output is selected.
+func EmitEvent(event models.Event) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if eventOutput == nil {
+		return
+	}
+	event.Version = config.EVENT_SCHEMA_VERSION
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode %s event: %v\n", event.Type, err)
+		return
+	}
+	eventOutput.Write(append(data, '\n'))
+}
+
+// EmitError emits an error event.
+func EmitError(err error) {
+	EmitEvent(models.Event{Type: ErrorEvent, Error: err.Error()})
+}
+
+// eventLogWriter turns the messages of the standard logger into error events
+// while still showing them on stderr. The standard logger is only used for
+// errors stopping the command, other messages go through Printf or an event.
+type eventLogWriter struct{}
+
+func (eventLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+	EmitEvent(models.Event{Type: ErrorEvent, Error: message})
+	fmt.Fprintln(os.Stderr, message)
+	return len(p), nil
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cli/go-gh/pkg/auth"
+)
+
+var host string
+
+// GetHost returns the GitHub host all API calls are made to. It defaults to
+// the host selected by GH_HOST or 'gh auth'.
+func GetHost() string {
+	if host != "" {
+		return host
+	}
+	defaultHost, _ := auth.DefaultHost()
+	return defaultHost
+}
+
+func SetHost(hostname string) {
+	host = NormalizeHost(hostname)
+}
+
+// ResolveHost returns the host recorded in the session the command works on,
+// so that sessions are always polled and downloaded from the host they were
+// submitted to. Otherwise it returns the flag value or the host of the
+// configuration file. An empty host falls back to GH_HOST and 'gh auth'.
+func ResolveHost(flagValue string, sessionName string) string {
+	if sessionName != "" {
+		if sessions, err := GetSessions(); err == nil {
+			if sessionHost := sessions[sessionName].Host; sessionHost != "" {
+				if flagValue != "" && NormalizeHost(flagValue) != sessionHost {
+					logger.Warn("Ignoring --hostname, the session was submitted to another host", "session", sessionName, "host", sessionHost)
+				}
+				return sessionHost
+			}
+		}
+	}
+	if flagValue != "" {
+		return flagValue
+	}
+	if configData, err := GetConfig(); err == nil {
+		return configData.Host
+	}
+	return ""
+}
+
+// NormalizeHost strips the scheme and path a host may have been given with.
+func NormalizeHost(hostname string) string {
+	hostname = strings.TrimPrefix(strings.TrimPrefix(hostname, "https://"), "http://")
+	if i := strings.Index(hostname, "/"); i >= 0 {
+		hostname = hostname[:i]
+	}
+	return strings.ToLower(hostname)
+}
+
+func isDotCom(hostname string) bool {
+	return hostname == "github.com"
+}
+
+// RESTURL returns the URL of a REST API path on the current host.
+func RESTURL(path string) string {
+	hostname := GetHost()
+	switch {
+	case isDotCom(hostname):
+		return "https://api.github.com/" + path
+	case hostname == "github.localhost":
+		return "http://api.github.localhost/" + path
+	}
+	return fmt.Sprintf("https://%s/api/v3/%s", hostname, path)
+}
+
+// WebURL returns the URL of a page on the current host.
+func WebURL(path string) string {
+	return fmt.Sprintf("https://%s/%s", GetHost(), path)
+}
@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+const (
+	SarifArtifact    = "sarif"
+	BqrsArtifact     = "bqrs"
+	DatabaseArtifact = "database"
+	FullArtifact     = "artifact"
+
+	ManifestFilename = "manifest.json"
+)
+
+var artifactExtensions = map[string]string{
+	SarifArtifact:    "sarif",
+	BqrsArtifact:     "bqrs",
+	DatabaseArtifact: "db.zip",
+	FullArtifact:     "artifact",
+}
+
+type layoutData struct {
+	Session  string
+	RunId    int
+	QueryId  string
+	Nwo      string
+	Owner    string
+	Repo     string
+	Language string
+	Ext      string
+}
+
+// ArtifactPath returns where an artifact of a repository in a run is stored.
+// It is used both to check for existing artifacts and to write new ones. For
+// FullArtifact, it is the directory holding the remaining artifact files.
+//
+// Without a layout, artifacts are stored flat in the output directory, named
+// after the repository and the run. A
+// layout is a template such as `{{.Session}}/{{.QueryId}}/{{.Owner}}/{{.Repo}}.sarif`
+// relative to the output directory. If it does not use `{{.Ext}}`, a trailing
+// `.sarif` is replaced with the extension of the artifact.
+func ArtifactPath(task models.DownloadTask, artifactType string) (string, error) {
+	if task.Layout != "" {
+		path, err := renderLayout(task.Layout, task, artifactType)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(task.OutputDir, path), nil
+	}
+	filename := strings.Replace(task.Nwo, "/", "_", -1)
+	// databases downloaded outside of a run have no run id
+	if task.RunId != 0 {
+		filename = fmt.Sprintf("%s_%d", filename, task.RunId)
+	}
+	switch artifactType {
+	case SarifArtifact:
+		filename = filename + ".sarif"
+	case BqrsArtifact:
+		filename = filename + ".bqrs"
+	case DatabaseArtifact:
+		filename = fmt.Sprintf("%s_%s_db.zip", filename, task.Language)
+	case FullArtifact:
+		filename = filename + "_artifact"
+	}
+	return filepath.Join(task.OutputDir, filename), nil
+}
+
+// QueryArtifactPath returns where the SARIF results of one of the queries
+// bundled in a run are stored. Layouts using {{.QueryId}} already give each
+// query its own path, otherwise the query id is appended to the run's path.
+func QueryArtifactPath(task models.DownloadTask, queryId string) (string, error) {
+	runPath, err := ArtifactPath(task, SarifArtifact)
+	if err != nil {
+		return "", err
+	}
+	task.QueryId = queryId
+	path, err := ArtifactPath(task, SarifArtifact)
+	if err != nil {
+		return "", err
+	}
+	if path == runPath {
+		path = strings.TrimSuffix(path, ".sarif") + "_" + strings.Replace(queryId, "/", "_", -1) + ".sarif"
+	}
+	return path, nil
+}
+
+// SarifPaths returns where the SARIF results of a repository in a run are
+// stored: one file per query for runs bundling several queries, otherwise the
+// single file of the run.
+func SarifPaths(task models.DownloadTask) ([]string, error) {
+	if len(task.Queries) == 0 {
+		path, err := ArtifactPath(task, SarifArtifact)
+		if err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+	var paths []string
+	for _, query := range task.Queries {
+		path, err := QueryArtifactPath(task, query.QueryId)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func renderLayout(layout string, task models.DownloadTask, artifactType string) (string, error) {
+	t, err := template.New("layout").Option("missingkey=error").Parse(layout)
+	if err != nil {
+		return "", err
+	}
+	owner, repo, _ := strings.Cut(task.Nwo, "/")
+	data := layoutData{
+		Session:  task.Session,
+		RunId:    task.RunId,
+		QueryId:  task.QueryId,
+		Nwo:      task.Nwo,
+		Owner:    owner,
+		Repo:     repo,
+		Language: task.Language,
+		Ext:      artifactExtensions[artifactType],
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	path := buf.String()
+	if !strings.Contains(layout, ".Ext") {
+		path = strings.TrimSuffix(path, ".sarif") + "." + artifactExtensions[artifactType]
+	}
+	// fields that are empty for the artifact leave empty directories or files
+	// named after their extension only
+	for _, segment := range strings.Split(filepath.ToSlash(path), "/") {
+		if segment == "" || segment == "."+artifactExtensions[artifactType] {
+			return "", fmt.Errorf("Layout %s resolves to %s which has an empty path component", layout, path)
+		}
+	}
+	path = filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Layout %s resolves to %s which is outside of the output directory", layout, path)
+	}
+	return path, nil
+}
+
+// ValidateLayout checks that a layout template can be rendered and that it
+// produces distinct paths for every artifact type.
+func ValidateLayout(layout string) error {
+	if layout == "" {
+		return nil
+	}
+	task := models.DownloadTask{Session: "session", RunId: 1, QueryId: "lang/query", Nwo: "owner/repo", Language: "lang"}
+	paths := make(map[string]bool)
+	for _, artifactType := range []string{SarifArtifact, BqrsArtifact, DatabaseArtifact, FullArtifact} {
+		path, err := renderLayout(layout, task, artifactType)
+		if err != nil {
+			return fmt.Errorf("Invalid layout: %v", err)
+		}
+		paths[path] = true
+	}
+	if len(paths) != 4 {
+		return errors.New("Invalid layout: SARIF, BQRS, database and artifact files would be written to the same path")
+	}
+	return nil
+}
+
+// ValidateDatabaseLayout checks a layout used for databases downloaded outside
+// of a session, which have no session, run or query id.
+func ValidateDatabaseLayout(layout string) error {
+	if err := ValidateLayout(layout); err != nil {
+		return err
+	}
+	if layout == "" {
+		return nil
+	}
+	task := models.DownloadTask{Session: "session", RunId: 1, QueryId: "lang/query", Nwo: "owner/repo", Language: "lang"}
+	path, _ := renderLayout(layout, task, DatabaseArtifact)
+	for _, field := range []string{"Session", "RunId", "QueryId"} {
+		withoutField := task
+		switch field {
+		case "Session":
+			withoutField.Session = ""
+		case "RunId":
+			withoutField.RunId = 0
+		case "QueryId":
+			withoutField.QueryId = ""
+		}
+		if fieldPath, err := renderLayout(layout, withoutField, DatabaseArtifact); err != nil || fieldPath != path {
+			return fmt.Errorf("Invalid layout: databases downloaded with db download have no {{.%s}}", field)
+		}
+	}
+	return nil
+}
+
+func NewManifestEntry(task models.DownloadTask, artifactType string, path string, sha256sum string) models.ManifestEntry {
+	if relPath, err := filepath.Rel(task.OutputDir, path); err == nil {
+		path = filepath.ToSlash(relPath)
+	}
+	return models.ManifestEntry{
+		Path:        path,
+		Artifact:    artifactType,
+		RunId:       task.RunId,
+		Nwo:         task.Nwo,
+		QueryId:     task.QueryId,
+		CommitSha:   task.CommitSha,
+		ResultCount: task.ResultCount,
+		Sha256:      sha256sum,
+	}
+}
+
+func Sha256Sum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func Sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ReadManifest reads the manifest of an output directory. It returns an empty
+// manifest if the directory has none.
+func ReadManifest(outputDir string) (models.Manifest, error) {
+	manifestPath := filepath.Join(outputDir, ManifestFilename)
+	var manifest models.Manifest
+	content, err := os.ReadFile(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	} else if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("Failed to parse %s: %v", manifestPath, err)
+	}
+	return manifest, nil
+}
+
+// UpdateManifest adds entries to the manifest of an output directory,
+// replacing existing entries for the same paths.
+func UpdateManifest(outputDir string, entries []models.ManifestEntry) error {
+	manifestPath := filepath.Join(outputDir, ManifestFilename)
+	manifest, err := ReadManifest(outputDir)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]models.ManifestEntry)
+	for _, entry := range manifest.Files {
+		files[entry.Path] = entry
+	}
+	for _, entry := range entries {
+		files[entry.Path] = entry
+	}
+	manifest.Files = make([]models.ManifestEntry, 0, len(files))
+	for _, entry := range files {
+		manifest.Files = append(manifest.Files, entry)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifestPath, content, 0644)
+}
+
+// ResolveLayout returns the layout from the flag value or, failing that, from
+// the configuration file.
+func ResolveLayout(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	configData, err := GetConfig()
+	if err != nil {
+		return ""
+	}
+	return configData.Layout
+}
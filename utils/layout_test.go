@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+func TestArtifactPath(t *testing.T) {
+	task := models.DownloadTask{
+		RunId:     42,
+		QueryId:   "java/sql-injection",
+		Nwo:       "owner/repo",
+		OutputDir: "out",
+		Language:  "java",
+		Session:   "session",
+	}
+	tests := []struct {
+		name         string
+		runId        int
+		layout       string
+		artifactType string
+		want         string
+		wantErr      bool
+	}{
+		{"sarif", 42, "", SarifArtifact, "owner_repo_42.sarif", false},
+		{"bqrs", 42, "", BqrsArtifact, "owner_repo_42.bqrs", false},
+		{"full artifact", 42, "", FullArtifact, "owner_repo_42_artifact", false},
+		// the name the download planning checks to skip existing databases
+		{"database", 42, "", DatabaseArtifact, "owner_repo_42_java_db.zip", false},
+		{"database outside of a run", 0, "", DatabaseArtifact, "owner_repo_java_db.zip", false},
+		{"layout sarif", 42, "{{.Session}}/{{.QueryId}}/{{.Owner}}/{{.Repo}}.sarif", SarifArtifact, "session/java/sql-injection/owner/repo.sarif", false},
+		{"layout bqrs", 42, "{{.Session}}/{{.QueryId}}/{{.Owner}}/{{.Repo}}.sarif", BqrsArtifact, "session/java/sql-injection/owner/repo.bqrs", false},
+		{"layout full artifact", 42, "{{.Session}}/{{.QueryId}}/{{.Owner}}/{{.Repo}}.sarif", FullArtifact, "session/java/sql-injection/owner/repo.artifact", false},
+		{"layout database", 42, "{{.Session}}/{{.QueryId}}/{{.Owner}}/{{.Repo}}.sarif", DatabaseArtifact, "session/java/sql-injection/owner/repo.db.zip", false},
+		{"layout with extension", 42, "{{.Language}}/{{.Nwo}}-{{.RunId}}.{{.Ext}}", DatabaseArtifact, "java/owner/repo-42.db.zip", false},
+		{"layout outside of the output directory", 42, "../{{.Repo}}.sarif", SarifArtifact, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := task
+			task.Layout = tt.layout
+			task.RunId = tt.runId
+			got, err := ArtifactPath(task, tt.artifactType)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ArtifactPath(%s) = %s, want an error", tt.artifactType, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := filepath.Join("out", filepath.FromSlash(tt.want))
+			if got != want {
+				t.Errorf("ArtifactPath(%s) = %s, want %s", tt.artifactType, got, want)
+			}
+		})
+	}
+}
+
+func TestArtifactPathWithEmptyField(t *testing.T) {
+	// databases downloaded with db download have no session
+	task := models.DownloadTask{Nwo: "owner/repo", OutputDir: "out", Language: "go"}
+	for _, layout := range []string{"{{.Session}}/{{.Owner}}/{{.Repo}}.sarif", "{{.Owner}}/{{.Repo}}/{{.Session}}.sarif"} {
+		task.Layout = layout
+		if got, err := ArtifactPath(task, DatabaseArtifact); err == nil {
+			t.Errorf("ArtifactPath with layout %s = %s, want an error", layout, got)
+		}
+	}
+}
+
+func TestValidateDatabaseLayout(t *testing.T) {
+	tests := []struct {
+		layout  string
+		wantErr bool
+	}{
+		{"", false},
+		{"{{.Language}}/{{.Owner}}/{{.Repo}}.sarif", false},
+		{"{{.Session}}/{{.QueryId}}/{{.Owner}}/{{.Repo}}.sarif", true},
+		{"{{.Owner}}/{{.Repo}}/{{.Session}}.sarif", true},
+		{"{{.Nwo}}-{{.RunId}}.{{.Ext}}", true},
+	}
+	for _, tt := range tests {
+		err := ValidateDatabaseLayout(tt.layout)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateDatabaseLayout(%q) = %v, want error %v", tt.layout, err, tt.wantErr)
+		}
+	}
+}
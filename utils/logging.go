@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum number of bytes of a body dumped by --debug-http
+	maxDebugBodySize = 64 * 1024
+)
+
+var (
+	logger    = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	debugHTTP bool
+	// the --log-file, if any
+	logFileLock sync.Mutex
+	logFile     *os.File
+)
+
+// Logger returns the logger configured with --log-level and --log-file.
+func Logger() *slog.Logger {
+	return logger
+}
+
+// SetupLogging configures the logger. Messages go to stderr unless a log file
+// is given. --debug-http dumps the API requests and responses at debug level,
+// so it lowers the level to debug if needed. The returned function flushes and
+// closes the log file once the command is done.
+func SetupLogging(level string, logFilePath string, httpTrace bool) (func() error, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return CloseLogFile, fmt.Errorf("Invalid log level '%s'. Valid levels are debug, info, warn and error", level)
+	}
+	if httpTrace && logLevel > slog.LevelDebug {
+		logLevel = slog.LevelDebug
+	}
+	var output io.Writer = os.Stderr
+	if logFilePath != "" {
+		file, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return CloseLogFile, err
+		}
+		CloseLogFile()
+		logFileLock.Lock()
+		logFile = file
+		logFileLock.Unlock()
+		output = file
+	}
+	logger = slog.New(slog.NewTextHandler(output, &slog.HandlerOptions{Level: logLevel}))
+	debugHTTP = httpTrace
+	return CloseLogFile, nil
+}
+
+// CloseLogFile flushes and closes the --log-file. It does nothing if there is
+// no log file or it is already closed.
+func CloseLogFile() error {
+	logFileLock.Lock()
+	defer logFileLock.Unlock()
+	if logFile == nil {
+		return nil
+	}
+	file := logFile
+	logFile = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// APITransport returns the transport for API requests that are not part of a
+// download, dumping them when --debug-http is set.
+func APITransport() http.RoundTripper {
+	return debugTransport(http.DefaultTransport)
+}
+
+func debugTransport(base http.RoundTripper) http.RoundTripper {
+	if !debugHTTP {
+		return base
+	}
+	return &debugRoundTripper{base: base}
+}
+
+// debugRoundTripper logs every request and response with the credentials
+// redacted.
+type debugRoundTripper struct {
+	base http.RoundTripper
+}
+
+func (t *debugRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	attrs := []any{"method", req.Method, "url", redactURL(req.URL), "headers", redactHeaders(req.Header)}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			attrs = append(attrs, "body", readDebugBody(body))
+			body.Close()
+		}
+	}
+	logger.Debug("HTTP request", attrs...)
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logger.Debug("HTTP request failed", "method", req.Method, "url", redactURL(req.URL), "error", err)
+		return nil, err
+	}
+	attrs = []any{"status", resp.Status, "url", redactURL(req.URL), "duration", time.Since(start), "headers", redactHeaders(resp.Header)}
+	// only dump bodies that are meant to be read, not artifacts or databases
+	if isTextContent(resp.Header.Get("Content-Type")) {
+		content, err := io.ReadAll(io.LimitReader(resp.Body, maxDebugBodySize))
+		if err == nil {
+			attrs = append(attrs, "body", string(content))
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(content), resp.Body), resp.Body}
+		}
+	}
+	logger.Debug("HTTP response", attrs...)
+	return resp, nil
+}
+
+// readDebugBody reads the start of a request body. Submitted query packs are
+// large base64 strings, so bodies are truncated.
+func readDebugBody(body io.Reader) string {
+	content, _ := io.ReadAll(io.LimitReader(body, maxDebugBodySize))
+	return strings.TrimSpace(string(content))
+}
+
+func isTextContent(contentType string) bool {
+	return strings.Contains(contentType, "json") || strings.HasPrefix(contentType, "text/")
+}
+
+// credentials that may be found in headers and in the query of signed URLs
+var (
+	sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Github-Otp", "Proxy-Authorization"}
+	sensitiveParams  = []string{"token", "access_token", "sig", "signature", "x-amz-signature", "x-amz-credential", "x-amz-security-token", "jwt"}
+)
+
+func redactHeaders(headers http.Header) string {
+	var lines []string
+	for name, values := range headers {
+		value := strings.Join(values, ", ")
+		for _, sensitive := range sensitiveHeaders {
+			if strings.EqualFold(name, sensitive) {
+				value = "[REDACTED]"
+			}
+		}
+		lines = append(lines, name+": "+value)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "; ")
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	for name := range query {
+		for _, sensitive := range sensitiveParams {
+			if strings.EqualFold(name, sensitive) {
+				query.Set(name, "REDACTED")
+			}
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	if redacted.User != nil {
+		redacted.User = url.User("REDACTED")
+	}
+	return redacted.String()
+}
@@ -0,0 +1,318 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scope/name of a CodeQL pack
+var packNamePattern = regexp.MustCompile(`^[a-z0-9-]+/[a-z0-9-]+$`)
+
+// PackRef is a reference to a query pack of the CodeQL package registry, in
+// the scope/name[@version][:path] form accepted by the CodeQL CLI.
+type PackRef struct {
+	Name    string
+	Version string
+	Path    string
+}
+
+// ParsePackRef parses a scope/name[@version][:path] pack reference.
+func ParsePackRef(ref string) (PackRef, error) {
+	nameVersion, path, _ := strings.Cut(ref, ":")
+	name, version, _ := strings.Cut(nameVersion, "@")
+	packRef := PackRef{Name: name, Version: version, Path: strings.TrimPrefix(path, "/")}
+	if !packNamePattern.MatchString(name) {
+		return packRef, fmt.Errorf("Invalid pack %q, packs are referenced as scope/name[@version][:path]", ref)
+	}
+	return packRef, nil
+}
+
+// String returns the reference in the form accepted by the CodeQL CLI.
+func (r PackRef) String() string {
+	ref := r.Name
+	if r.Version != "" {
+		ref += "@" + r.Version
+	}
+	if r.Path != "" {
+		ref += ":" + r.Path
+	}
+	return ref
+}
+
+// PackCacheDir returns the CodeQL package cache, where the CLI keeps the
+// downloaded packs as <scope>/<name>/<version>.
+func PackCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".codeql", "packages")
+}
+
+// DownloadPack returns the directory of a pack in the package cache,
+// downloading it from the registry unless the requested version is cached.
+func DownloadPack(ref PackRef) (string, error) {
+	packDir := filepath.Join(PackCacheDir(), filepath.FromSlash(ref.Name))
+	if ref.Version != "" && ValidateVersion(ref.Version) == nil {
+		if dir := filepath.Join(packDir, ref.Version); isPackDir(dir) {
+			Printf("Using %s@%s from the package cache\n", ref.Name, ref.Version)
+			return dir, nil
+		}
+	}
+
+	download := PackRef{Name: ref.Name, Version: ref.Version}.String()
+	Printf("Downloading %s\n", download)
+	output, err := RunCodeQLCommand("", false, "pack", "download", "--format=json", download)
+	if err != nil {
+		return "", fmt.Errorf("Failed to download %s: %v", download, codeqlError(err))
+	}
+	var result struct {
+		Packs []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			PackDir string `json:"packDir"`
+		} `json:"packs"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return "", fmt.Errorf("Failed to parse the output of downloading %s: %v", download, err)
+	}
+	for _, pack := range result.Packs {
+		if pack.Name != ref.Name {
+			continue
+		}
+		if pack.PackDir != "" && isPackDir(pack.PackDir) {
+			return pack.PackDir, nil
+		}
+		if dir := filepath.Join(packDir, pack.Version); isPackDir(dir) {
+			return dir, nil
+		}
+	}
+	// a pinned version is never replaced with another cached version
+	if ref.Version != "" {
+		if dir := filepath.Join(packDir, ref.Version); isPackDir(dir) {
+			return dir, nil
+		}
+		return "", fmt.Errorf("Pack %s@%s not found in the package cache %s after downloading it", ref.Name, ref.Version, PackCacheDir())
+	}
+	// fall back to the newest cached version
+	entries, _ := os.ReadDir(packDir)
+	latest := ""
+	for _, entry := range entries {
+		if entry.IsDir() && isPackDir(filepath.Join(packDir, entry.Name())) && (latest == "" || CompareVersions(entry.Name(), latest) > 0) {
+			latest = entry.Name()
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("Pack %s not found in the package cache %s after downloading it", ref.Name, PackCacheDir())
+	}
+	return filepath.Join(packDir, latest), nil
+}
+
+// ResolvePackQueries returns the queries selected by a pack reference: the
+// query its path points to, the queries of the suite or directory it points
+// to, or the default suite of the pack.
+func ResolvePackQueries(ref PackRef, packDir string, additionalPacks string) []string {
+	if strings.HasSuffix(ref.Path, ".ql") {
+		return []string{filepath.Join(packDir, filepath.FromSlash(ref.Path))}
+	}
+	// the CLI resolves the suites of cached packs by reference
+	return ResolveQueries(additionalPacks, ref.String())
+}
+
+// ResolveModelPack resolves a model pack given as the path of a local pack or
+// as a scope/name[@version] reference to the CodeQL package registry. It
+// returns the pack with the directory of a local pack, which has to be added to
+// the additional packs so that the CLI finds it.
+func ResolveModelPack(pack string) (PackRef, string, error) {
+	if isPackDir(pack) {
+		dir, err := filepath.Abs(pack)
+		if err != nil {
+			return PackRef{}, "", err
+		}
+		name, err := packName(dir)
+		if err != nil {
+			return PackRef{}, "", err
+		}
+		return PackRef{Name: name}, dir, nil
+	}
+	ref, err := ParsePackRef(pack)
+	if err != nil {
+		return ref, "", fmt.Errorf("Model pack %q is neither a pack directory nor a pack reference", pack)
+	}
+	if ref.Path != "" {
+		return ref, "", fmt.Errorf("Model pack %q cannot select a path inside the pack", pack)
+	}
+	return ref, "", nil
+}
+
+// PackDataExtensions returns the data extension files declared with the
+// dataExtensions globs of a pack.
+func PackDataExtensions(dir string) ([]string, error) {
+	data, err := readPackFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	switch value := data["dataExtensions"].(type) {
+	case string:
+		patterns = []string{value}
+	case []interface{}:
+		for _, pattern := range value {
+			if pattern, ok := pattern.(string); ok {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var globs []*regexp.Regexp
+	for _, pattern := range patterns {
+		glob, err := globPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid dataExtensions pattern %q in %s: %v", pattern, packFile(dir), err)
+		}
+		globs = append(globs, glob)
+	}
+	var files []string
+	err = filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			// skip the installed dependencies and the compilation cache
+			if name := entry.Name(); path != dir && (name == ".codeql" || name == ".cache") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, _ := filepath.Rel(dir, path)
+		for _, glob := range globs {
+			if glob.MatchString(filepath.ToSlash(relPath)) {
+				files = append(files, path)
+				break
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// AddPackDependencies makes a pack depend on the given packs, so that the data
+// extensions of model packs are bundled with it and applied to its queries.
+func AddPackDependencies(dir string, packs []PackRef) error {
+	if len(packs) == 0 {
+		return nil
+	}
+	data, err := readPackFile(dir)
+	if err != nil {
+		return err
+	}
+	dependencies, _ := data["dependencies"].(map[string]interface{})
+	if dependencies == nil {
+		dependencies = make(map[string]interface{})
+	}
+	for _, pack := range packs {
+		version := pack.Version
+		if version == "" {
+			version = "*"
+		}
+		dependencies[pack.Name] = version
+	}
+	data["dependencies"] = dependencies
+	content, err := yaml.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(packFile(dir), content, 0644)
+}
+
+// globPattern converts a glob of a pack file, where ** matches any number of
+// directories, to a regular expression matching slash separated paths.
+func globPattern(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	pattern = strings.TrimPrefix(filepath.ToSlash(pattern), "./")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				re.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				re.WriteString(".*")
+				i++
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+func readPackFile(dir string) (map[string]interface{}, error) {
+	path := packFile(dir)
+	if path == "" {
+		return nil, fmt.Errorf("No qlpack.yml or codeql-pack.yml found in %s", dir)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	return data, nil
+}
+
+func packName(dir string) (string, error) {
+	data, err := readPackFile(dir)
+	if err != nil {
+		return "", err
+	}
+	name, _ := data["name"].(string)
+	if name == "" {
+		return "", fmt.Errorf("%s has no pack name", packFile(dir))
+	}
+	return name, nil
+}
+
+func isPackDir(dir string) bool {
+	return packFile(dir) != ""
+}
+
+// packFile returns the pack definition file of a directory, either qlpack.yml
+// or codeql-pack.yml, or an empty string if it is not a pack.
+func packFile(dir string) string {
+	for _, name := range []string{"qlpack.yml", "codeql-pack.yml"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return ""
+}
+
+// codeqlError returns the error output of a failed CodeQL command.
+func codeqlError(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if message := strings.TrimSpace(string(exitErr.Stderr)); message != "" {
+			return message
+		}
+	}
+	return err.Error()
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+var activeProfile string
+
+// GetProfile returns the name of the active profile, if any.
+func GetProfile() string {
+	return activeProfile
+}
+
+// SetProfile selects the profile whose settings GetConfig applies on top of
+// the settings of the config files.
+func SetProfile(name string) error {
+	if name == "" {
+		activeProfile = ""
+		return nil
+	}
+	activeProfile = ""
+	configData, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	if _, ok := configData.Profiles[name]; !ok {
+		return fmt.Errorf("Profile '%s' not found in the config files. Available profiles: %v", name, ProfileNames(configData))
+	}
+	activeProfile = name
+	return nil
+}
+
+// ResolveProfile returns the profile from the flag value or, for a command
+// working on an existing session, the profile recorded in the session. Only the
+// flag overrides the recorded profile, so that GH_MRVA_PROFILE does not apply
+// to sessions submitted with other settings. Otherwise it returns the
+// GH_MRVA_PROFILE environment variable.
+func ResolveProfile(flagValue string, sessionName string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if sessionName != "" {
+		if sessions, err := GetSessions(); err == nil {
+			if session, ok := sessions[sessionName]; ok {
+				return session.Profile
+			}
+		}
+	}
+	return os.Getenv("GH_MRVA_PROFILE")
+}
+
+// ProfileNames returns the names of the profiles defined in a configuration.
+func ProfileNames(configData models.Config) []string {
+	var names []string
+	for name := range configData.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile overrides the settings of a configuration with the ones set in
+// a profile.
+func applyProfile(configData models.Config, profile models.Config) models.Config {
+	merged := reflect.ValueOf(&configData).Elem()
+	overrides := reflect.ValueOf(profile)
+	for i := 0; i < overrides.NumField(); i++ {
+		if merged.Type().Field(i).Name == "Profiles" {
+			continue
+		}
+		if field := overrides.Field(i); !field.IsZero() {
+			merged.Field(i).Set(field)
+		}
+	}
+	return configData
+}
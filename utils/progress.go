@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	progressBarWidth = 30
+	progressInterval = 200 * time.Millisecond
+	// transfers smaller than this are only reflected in the overall bar
+	progressLargeTransfer = 10 * 1024 * 1024
+)
+
+var (
+	progressLock sync.Mutex
+	progress     *Progress
+)
+
+// Progress reports the progress of a batch of downloads. On a terminal it
+// redraws an overall bar with the bytes downloaded, throughput and ETA, and a
+// bar per large transfer. Otherwise it logs a line per completed task.
+type Progress struct {
+	lock        sync.Mutex
+	out         io.Writer
+	interactive bool
+	label       string
+	total       int
+	done        int
+	failed      int
+	bytes       int64
+	totalBytes  int64
+	start       time.Time
+	rate        float64
+	lastBytes   int64
+	lastSample  time.Time
+	transfers   []*ProgressTransfer
+	lines       int
+	stop        chan bool
+	stopped     chan bool
+}
+
+// ProgressTransfer tracks the bytes received for a single download. All its
+// methods are no-ops on a nil transfer.
+type ProgressTransfer struct {
+	progress *Progress
+	name     string
+	size     int64
+	received int64
+}
+
+// IsTerminal reports whether stdout is attached to a terminal.
+func IsTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// StartProgress starts reporting the progress of total tasks. Downloads
+// started by this package are tracked until StopProgress is called.
+func StartProgress(label string, total int, interactive bool) *Progress {
+	now := time.Now()
+	p := &Progress{
+		out:         Out(),
+		interactive: interactive,
+		label:       label,
+		total:       total,
+		start:       now,
+		lastSample:  now,
+		stop:        make(chan bool),
+		stopped:     make(chan bool),
+	}
+	progressLock.Lock()
+	progress = p
+	progressLock.Unlock()
+	if interactive {
+		go p.run()
+	} else {
+		close(p.stopped)
+	}
+	return p
+}
+
+// StopProgress stops the current progress report and prints a summary.
+func StopProgress() {
+	progressLock.Lock()
+	p := progress
+	progress = nil
+	progressLock.Unlock()
+	if p == nil {
+		return
+	}
+	if p.interactive {
+		close(p.stop)
+	}
+	<-p.stopped
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	elapsed := time.Since(p.start)
+	fmt.Fprintf(p.out, "%d/%d tasks completed, %d failed, %s downloaded in %s (%s/s)\n",
+		p.done-p.failed, p.total, p.failed, FormatBytes(p.bytes), elapsed.Round(time.Second), FormatBytes(int64(float64(p.bytes)/elapsed.Seconds())))
+}
+
+func getProgress() *Progress {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	return progress
+}
+
+// Logf prints a message, keeping it above the progress bars when they are
+// displayed.
+func Logf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	p := getProgress()
+	if p == nil {
+		Print(message)
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	fmt.Fprint(p.out, message)
+	p.render()
+}
+
+// AddProgressBytes adds the expected size of the downloads to the current
+// progress report so the ETA can be computed from bytes instead of tasks.
+func AddProgressBytes(size int64) {
+	if p := getProgress(); p != nil && size > 0 {
+		p.lock.Lock()
+		p.totalBytes += size
+		p.lock.Unlock()
+	}
+}
+
+// CompleteProgressTask records a completed task in the current progress
+// report and logs the message.
+func CompleteProgressTask(message string, err error) {
+	p := getProgress()
+	if p == nil {
+		if err != nil {
+			Printf("%s: %v\n", message, err)
+		} else {
+			Println(message)
+		}
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done++
+	if err != nil {
+		p.failed++
+		message = fmt.Sprintf("%s: %v", message, err)
+	}
+	p.clear()
+	fmt.Fprintf(p.out, "%s (%d/%d)\n", message, p.done, p.total)
+	p.render()
+}
+
+// StartTransfer tracks a download of size bytes, or -1 if unknown, in the
+// current progress report. It returns nil when there is no progress report.
+func StartTransfer(name string, size int64) *ProgressTransfer {
+	p := getProgress()
+	if p == nil {
+		return nil
+	}
+	transfer := &ProgressTransfer{progress: p, name: name, size: size}
+	p.lock.Lock()
+	p.transfers = append(p.transfers, transfer)
+	p.lock.Unlock()
+	return transfer
+}
+
+// Reader wraps r so that the bytes read are counted by the transfer.
+func (t *ProgressTransfer) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &progressReader{Reader: r, transfer: t}
+}
+
+// Finish removes the transfer from the progress bars.
+func (t *ProgressTransfer) Finish() {
+	if t == nil {
+		return
+	}
+	p := t.progress
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, transfer := range p.transfers {
+		if transfer == t {
+			p.transfers = append(p.transfers[:i], p.transfers[i+1:]...)
+			break
+		}
+	}
+}
+
+type progressReader struct {
+	io.Reader
+	transfer *ProgressTransfer
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		p := r.transfer.progress
+		p.lock.Lock()
+		r.transfer.received += int64(n)
+		p.bytes += int64(n)
+		p.lock.Unlock()
+	}
+	return n, err
+}
+
+func (p *Progress) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.lock.Lock()
+			p.sample()
+			p.clear()
+			p.render()
+			p.lock.Unlock()
+		}
+	}
+}
+
+// sample updates the throughput, smoothing it over the last few seconds.
+func (p *Progress) sample() {
+	now := time.Now()
+	elapsed := now.Sub(p.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	current := float64(p.bytes-p.lastBytes) / elapsed
+	if p.rate == 0 {
+		p.rate = current
+	} else {
+		p.rate = 0.8*p.rate + 0.2*current
+	}
+	p.lastBytes = p.bytes
+	p.lastSample = now
+}
+
+// eta estimates the remaining time from the bytes left when the total size is
+// known, and from the tasks left otherwise.
+func (p *Progress) eta() string {
+	if p.totalBytes > 0 && p.rate > 0 {
+		remaining := p.totalBytes - p.bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		return (time.Duration(float64(remaining)/p.rate) * time.Second).Round(time.Second).String()
+	}
+	if p.done > 0 && p.done < p.total {
+		perTask := time.Since(p.start) / time.Duration(p.done)
+		return (perTask * time.Duration(p.total-p.done)).Round(time.Second).String()
+	}
+	return "-"
+}
+
+// clear erases the bars drawn by the last render. Callers must hold the lock.
+func (p *Progress) clear() {
+	if !p.interactive || p.lines == 0 {
+		return
+	}
+	fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.lines)
+	p.lines = 0
+}
+
+// render draws the bars. Callers must hold the lock.
+func (p *Progress) render() {
+	if !p.interactive {
+		return
+	}
+	ratio := 0.0
+	if p.total > 0 {
+		ratio = float64(p.done) / float64(p.total)
+	}
+	fmt.Fprintf(p.out, "%s %s %d/%d  %s  %s/s  ETA %s\n", p.label, progressBar(ratio), p.done, p.total, FormatBytes(p.bytes), FormatBytes(int64(p.rate)), p.eta())
+	p.lines = 1
+	for _, transfer := range p.transfers {
+		if transfer.size < progressLargeTransfer && transfer.received < progressLargeTransfer {
+			continue
+		}
+		if transfer.size > 0 {
+			fmt.Fprintf(p.out, "  %s %s %s/%s\n", progressBar(float64(transfer.received)/float64(transfer.size)), transfer.name, FormatBytes(transfer.received), FormatBytes(transfer.size))
+		} else {
+			fmt.Fprintf(p.out, "  %s %s\n", transfer.name, FormatBytes(transfer.received))
+		}
+		p.lines++
+	}
+}
+
+func progressBar(ratio float64) string {
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * progressBarWidth)
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "]"
+}
+
+// FormatBytes formats a size using binary units.
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
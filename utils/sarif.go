@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+// LoadFindings reads the results of a downloaded SARIF file.
+func LoadFindings(sarifPath string) ([]models.Finding, error) {
+	content, err := os.ReadFile(sarifPath)
+	if err != nil {
+		return nil, err
+	}
+	var sarif map[string]interface{}
+	err = json.Unmarshal(content, &sarif)
+	if err != nil {
+		return nil, err
+	}
+	var findings []models.Finding
+	for _, result := range sarifResults(sarif) {
+		finding := models.Finding{
+			RuleId: sarifRuleId(result),
+			Path:   sarifResultPath(result),
+		}
+		if message, ok := result["message"].(map[string]interface{}); ok {
+			finding.Message, _ = message["text"].(string)
+		}
+		if partialFingerprints, ok := result["partialFingerprints"].(map[string]interface{}); ok {
+			finding.Fingerprint, _ = partialFingerprints["primaryLocationLineHash"].(string)
+		}
+		physicalLocation := sarifPhysicalLocation(result)
+		if region, ok := physicalLocation["region"].(map[string]interface{}); ok {
+			if startLine, ok := region["startLine"].(float64); ok {
+				finding.StartLine = int(startLine)
+			}
+			finding.Snippet = sarifSnippet(region)
+		}
+		// prefer the context region as it includes the surrounding lines
+		if contextRegion, ok := physicalLocation["contextRegion"].(map[string]interface{}); ok {
+			if snippet := sarifSnippet(contextRegion); snippet != "" {
+				finding.Snippet = snippet
+			}
+		}
+		findings = append(findings, finding)
+	}
+	return findings, nil
+}
+
+func sarifResults(sarif map[string]interface{}) []map[string]interface{} {
+	var results []map[string]interface{}
+	runs, _ := sarif["runs"].([]interface{})
+	for _, r := range runs {
+		run, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		runResults, _ := run["results"].([]interface{})
+		for _, res := range runResults {
+			if result, ok := res.(map[string]interface{}); ok {
+				results = append(results, result)
+			}
+		}
+	}
+	return results
+}
+
+func sarifRuleId(result map[string]interface{}) string {
+	if ruleId, ok := result["ruleId"].(string); ok {
+		return ruleId
+	}
+	if rule, ok := result["rule"].(map[string]interface{}); ok {
+		if id, ok := rule["id"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+func sarifPhysicalLocation(result map[string]interface{}) map[string]interface{} {
+	locations, _ := result["locations"].([]interface{})
+	if len(locations) == 0 {
+		return nil
+	}
+	location, _ := locations[0].(map[string]interface{})
+	physicalLocation, _ := location["physicalLocation"].(map[string]interface{})
+	return physicalLocation
+}
+
+func sarifResultPath(result map[string]interface{}) string {
+	artifactLocation, _ := sarifPhysicalLocation(result)["artifactLocation"].(map[string]interface{})
+	uri, _ := artifactLocation["uri"].(string)
+	return uri
+}
+
+func sarifSnippet(region map[string]interface{}) string {
+	snippet, _ := region["snippet"].(map[string]interface{})
+	text, _ := snippet["text"].(string)
+	return text
+}
+
+func sarifFingerprints(result map[string]interface{}) []string {
+	var fingerprints []string
+	for _, key := range []string{"partialFingerprints", "fingerprints"} {
+		values, _ := result[key].(map[string]interface{})
+		for _, value := range values {
+			if fingerprint, ok := value.(string); ok {
+				fingerprints = append(fingerprints, fingerprint)
+			}
+		}
+	}
+	return fingerprints
+}
+
+const (
+	// name of the synthetic pack the query is bundled into on submission
+	remoteQueryPack = "codeql-remote/query"
+	// id given to the submitted query inside the synthetic pack
+	remoteQueryId = "remote-query"
+)
+
+// RewriteSarifQueryId replaces the synthetic ids of the remote query pack with
+// the real query id and restores the query metadata on the rule descriptors.
+// Only rule descriptors of the remote query pack and results referencing them
+// are modified.
+func RewriteSarifQueryId(content []byte, queryId string, metadata map[string]string) ([]byte, error) {
+	var sarif map[string]interface{}
+	err := json.Unmarshal(content, &sarif)
+	if err != nil {
+		return nil, err
+	}
+	if queryId == "" {
+		queryId = metadata["id"]
+	}
+	if queryId == "" {
+		return content, nil
+	}
+	runs, _ := sarif["runs"].([]interface{})
+	for _, r := range runs {
+		run, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, component := range sarifToolComponents(run) {
+			if name, _ := component["name"].(string); name != remoteQueryPack && !sarifHasRemoteRule(component) {
+				continue
+			}
+			rules, _ := component["rules"].([]interface{})
+			for _, r := range rules {
+				rule, ok := r.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if id, _ := rule["id"].(string); isRemoteQueryId(id) {
+					rule["id"] = queryId
+					restoreRuleMetadata(rule, metadata)
+				}
+			}
+		}
+		results, _ := run["results"].([]interface{})
+		for _, res := range results {
+			result, ok := res.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if ruleId, _ := result["ruleId"].(string); isRemoteQueryId(ruleId) {
+				result["ruleId"] = queryId
+			}
+			if rule, ok := result["rule"].(map[string]interface{}); ok {
+				if id, _ := rule["id"].(string); isRemoteQueryId(id) {
+					rule["id"] = queryId
+				}
+			}
+		}
+	}
+	return json.MarshalIndent(sarif, "", "  ")
+}
+
+// SplitSarifByQueryId splits the results of a run bundling several queries into
+// one SARIF log per query id. The rule descriptors are kept as they are, so
+// that rule indexes remain valid.
+func SplitSarifByQueryId(content []byte, queryIds []string) (map[string][]byte, error) {
+	split := make(map[string][]byte)
+	for _, queryId := range queryIds {
+		var sarif map[string]interface{}
+		err := json.Unmarshal(content, &sarif)
+		if err != nil {
+			return nil, err
+		}
+		runs, _ := sarif["runs"].([]interface{})
+		for _, r := range runs {
+			run, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			results, _ := run["results"].([]interface{})
+			queryResults := []interface{}{}
+			for _, res := range results {
+				if result, ok := res.(map[string]interface{}); ok && sarifRuleId(result) == queryId {
+					queryResults = append(queryResults, result)
+				}
+			}
+			run["results"] = queryResults
+		}
+		split[queryId], err = json.MarshalIndent(sarif, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return split, nil
+}
+
+func isRemoteQueryId(id string) bool {
+	return id == remoteQueryId || id == remoteQueryPack+"/"+remoteQueryId
+}
+
+func sarifToolComponents(run map[string]interface{}) []map[string]interface{} {
+	var components []map[string]interface{}
+	tool, _ := run["tool"].(map[string]interface{})
+	if driver, ok := tool["driver"].(map[string]interface{}); ok {
+		components = append(components, driver)
+	}
+	extensions, _ := tool["extensions"].([]interface{})
+	for _, e := range extensions {
+		if extension, ok := e.(map[string]interface{}); ok {
+			components = append(components, extension)
+		}
+	}
+	return components
+}
+
+func sarifHasRemoteRule(component map[string]interface{}) bool {
+	rules, _ := component["rules"].([]interface{})
+	for _, r := range rules {
+		if rule, ok := r.(map[string]interface{}); ok {
+			if id, _ := rule["id"].(string); isRemoteQueryId(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restoreRuleMetadata fills a SARIF rule descriptor with the metadata
+// reported by `codeql resolve metadata` for the submitted query.
+func restoreRuleMetadata(rule map[string]interface{}, metadata map[string]string) {
+	if len(metadata) == 0 {
+		return
+	}
+	if name := metadata["name"]; name != "" {
+		rule["name"] = metadata["id"]
+		rule["shortDescription"] = map[string]interface{}{"text": name}
+	}
+	if description := metadata["description"]; description != "" {
+		rule["fullDescription"] = map[string]interface{}{"text": description}
+	}
+	properties, ok := rule["properties"].(map[string]interface{})
+	if !ok {
+		properties = make(map[string]interface{})
+		rule["properties"] = properties
+	}
+	for _, key := range []string{"id", "name", "description", "kind", "precision", "problem.severity", "security-severity"} {
+		if value := metadata[key]; value != "" {
+			properties[key] = value
+		}
+	}
+	if tags := strings.Fields(metadata["tags"]); len(tags) > 0 {
+		properties["tags"] = tags
+	}
+	if level := sarifLevel(metadata["problem.severity"]); level != "" {
+		rule["defaultConfiguration"] = map[string]interface{}{"enabled": true, "level": level}
+	}
+}
+
+// sarifLevel maps a CodeQL problem severity to a SARIF level.
+func sarifLevel(severity string) string {
+	switch severity {
+	case "error":
+		return "error"
+	case "warning":
+		return "warning"
+	case "recommendation":
+		return "note"
+	}
+	return ""
+}
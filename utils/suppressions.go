@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"gopkg.in/yaml.v3"
+)
+
+var suppressions []models.Suppression
+
+func GetSuppressions() []models.Suppression {
+	return suppressions
+}
+
+func SetSuppressions(s []models.Suppression) {
+	suppressions = s
+}
+
+// LoadSuppressions reads a baseline file. YAML files contain a list of
+// suppression entries, each with a justification and an expiry date. SARIF
+// files are turned into one entry per result, scoped to the repository the
+// results were found in: a baseline records results that were already
+// reviewed, so its entries are justified as present in the baseline and do not
+// expire.
+func LoadSuppressions(path string) ([]models.Suppression, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, ".sarif") || strings.HasSuffix(path, ".sarif.json") {
+		return suppressionsFromSarif(path, content)
+	}
+	var suppressionsFile models.SuppressionsFile
+	err = yaml.Unmarshal(content, &suppressionsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse suppressions file %s: %v", path, err)
+	}
+	var active []models.Suppression
+	for i, s := range suppressionsFile.Suppressions {
+		if s.Repository == "" && s.Rule == "" && s.Path == "" && s.Fingerprint == "" {
+			return nil, fmt.Errorf("Suppression #%d in %s does not match on repository, rule, path or fingerprint", i+1, path)
+		}
+		if s.Justification == "" {
+			return nil, fmt.Errorf("Suppression #%d in %s has no justification", i+1, path)
+		}
+		if s.Expires.IsZero() {
+			return nil, fmt.Errorf("Suppression #%d in %s has no expiry date", i+1, path)
+		}
+		if s.Expires.Before(time.Now()) {
+			Printf("Ignoring suppression #%d in %s: expired on %s\n", i+1, path, s.Expires.Format("2006-01-02"))
+			continue
+		}
+		active = append(active, s)
+	}
+	return active, nil
+}
+
+func suppressionsFromSarif(path string, content []byte) ([]models.Suppression, error) {
+	var sarif map[string]interface{}
+	err := json.Unmarshal(content, &sarif)
+	if err != nil {
+		return nil, err
+	}
+	nwo := sarifRepository(sarif)
+	if nwo == "" {
+		nwo = manifestRepository(path)
+	}
+	if nwo == "" {
+		return nil, fmt.Errorf("Failed to find the repository of the baseline %s: use a SARIF file of a download output directory, next to its %s", path, ManifestFilename)
+	}
+	var baseline []models.Suppression
+	for _, result := range sarifResults(sarif) {
+		s := models.Suppression{
+			Repository:    nwo,
+			Rule:          sarifRuleId(result),
+			Path:          sarifResultPath(result),
+			Justification: "Present in baseline",
+		}
+		if partialFingerprints, ok := result["partialFingerprints"].(map[string]interface{}); ok {
+			s.Fingerprint, _ = partialFingerprints["primaryLocationLineHash"].(string)
+		}
+		if s.Rule == "" && s.Path == "" && s.Fingerprint == "" {
+			continue
+		}
+		baseline = append(baseline, s)
+	}
+	return baseline, nil
+}
+
+// sarifRepository returns the repository recorded in the version control
+// provenance of a SARIF document, if it is a GitHub repository.
+func sarifRepository(sarif map[string]interface{}) string {
+	runs, _ := sarif["runs"].([]interface{})
+	for _, r := range runs {
+		run, _ := r.(map[string]interface{})
+		provenances, _ := run["versionControlProvenance"].([]interface{})
+		for _, p := range provenances {
+			provenance, _ := p.(map[string]interface{})
+			repositoryUri, _ := provenance["repositoryUri"].(string)
+			u, err := url.Parse(repositoryUri)
+			if err != nil {
+				continue
+			}
+			nwo := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+			if strings.Count(nwo, "/") == 1 {
+				return nwo
+			}
+		}
+	}
+	return ""
+}
+
+// manifestRepository looks up the repository of a downloaded SARIF file in the
+// manifest of the output directory it was downloaded to.
+func manifestRepository(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for dir := filepath.Dir(absPath); ; dir = filepath.Dir(dir) {
+		if manifest, err := ReadManifest(dir); err == nil {
+			for _, entry := range manifest.Files {
+				if filepath.Join(dir, filepath.FromSlash(entry.Path)) == absPath {
+					return entry.Nwo
+				}
+			}
+		}
+		if filepath.Dir(dir) == dir {
+			return ""
+		}
+	}
+}
+
+// SuppressSarif marks every result in the SARIF document that matches a
+// suppression entry with an external SARIF suppression and returns the
+// number of suppressed results.
+func SuppressSarif(content []byte, nwo string, entries []models.Suppression) ([]byte, int, error) {
+	if len(entries) == 0 {
+		return content, 0, nil
+	}
+	var sarif map[string]interface{}
+	err := json.Unmarshal(content, &sarif)
+	if err != nil {
+		return content, 0, err
+	}
+	count := 0
+	for _, result := range sarifResults(sarif) {
+		for _, s := range entries {
+			if !suppressionMatchesResult(s, nwo, result) {
+				continue
+			}
+			existing, _ := result["suppressions"].([]interface{})
+			result["suppressions"] = append(existing, map[string]interface{}{
+				"kind":          "external",
+				"status":        "accepted",
+				"justification": s.Justification,
+			})
+			count++
+			break
+		}
+	}
+	if count == 0 {
+		return content, 0, nil
+	}
+	content, err = json.MarshalIndent(sarif, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, count, nil
+}
+
+// SuppressFindings moves repositories whose findings are entirely covered by
+// a repository or rule suppression out of the findings totals.
+func SuppressFindings(results *models.Results, entries []models.Suppression) {
+	var remaining []models.RepoWithFindings
+	for _, repo := range results.ResositoriesWithFindings {
+		suppressed := false
+		for _, s := range entries {
+			if s.Path != "" || s.Fingerprint != "" {
+				continue
+			}
+			if matchesGlob(s.Repository, repo.Nwo) && (s.Rule == "" || s.Rule == repo.QueryId) {
+				suppressed = true
+				break
+			}
+		}
+		if suppressed {
+			results.SuppressedRepositories = append(results.SuppressedRepositories, repo)
+			results.TotalSuppressedFindingsCount += repo.Count
+			results.TotalSuppressedRepositories += 1
+			results.TotalFindingsCount -= repo.Count
+			results.TotalRepositoriesWithFindings -= 1
+		} else {
+			remaining = append(remaining, repo)
+		}
+	}
+	results.ResositoriesWithFindings = remaining
+}
+
+// SuppressDownloadedFindings moves the results suppressed in the downloaded
+// SARIF files of an output directory out of the findings totals. Path and
+// fingerprint suppressions can only be matched against the SARIF results, so
+// they are counted when the files are downloaded and recorded in the manifest.
+// The results of runs bundling several queries are split into one file per
+// query, whose counts add up to the ones of the run.
+func SuppressDownloadedFindings(results *models.Results, manifest models.Manifest, runs []models.Run) {
+	suppressed := make(map[string]int)
+	for _, entry := range manifest.Files {
+		if entry.Artifact == SarifArtifact && entry.Suppressed > 0 {
+			suppressed[suppressionKey(entry.Nwo, entry.RunId, entry.QueryId)] += entry.Suppressed
+		}
+	}
+	if len(suppressed) == 0 {
+		return
+	}
+	queryIds := make(map[int][]string)
+	for _, run := range runs {
+		for _, query := range run.Queries {
+			queryIds[run.Id] = append(queryIds[run.Id], query.QueryId)
+		}
+	}
+	var remaining []models.RepoWithFindings
+	for _, repo := range results.ResositoriesWithFindings {
+		count := 0
+		if ids, ok := queryIds[repo.RunId]; ok {
+			for _, queryId := range ids {
+				count += suppressed[suppressionKey(repo.Nwo, repo.RunId, queryId)]
+			}
+		} else {
+			count = suppressed[suppressionKey(repo.Nwo, repo.RunId, repo.QueryId)]
+		}
+		if count > repo.Count {
+			count = repo.Count
+		}
+		results.TotalSuppressedFindingsCount += count
+		results.TotalFindingsCount -= count
+		if count > 0 && count == repo.Count {
+			results.SuppressedRepositories = append(results.SuppressedRepositories, repo)
+			results.TotalSuppressedRepositories += 1
+			results.TotalRepositoriesWithFindings -= 1
+		} else {
+			repo.Count -= count
+			remaining = append(remaining, repo)
+		}
+	}
+	results.ResositoriesWithFindings = remaining
+}
+
+func suppressionKey(nwo string, runId int, queryId string) string {
+	return fmt.Sprintf("%s/%d/%s", nwo, runId, queryId)
+}
+
+func suppressionMatchesResult(s models.Suppression, nwo string, result map[string]interface{}) bool {
+	if s.Repository != "" && !matchesGlob(s.Repository, nwo) {
+		return false
+	}
+	if s.Rule != "" && s.Rule != sarifRuleId(result) {
+		return false
+	}
+	if s.Path != "" && !matchesGlob(s.Path, sarifResultPath(result)) {
+		return false
+	}
+	if s.Fingerprint != "" {
+		found := false
+		for _, fingerprint := range sarifFingerprints(result) {
+			if fingerprint == s.Fingerprint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesGlob matches value against a glob pattern where `*` does not cross
+// a `/` and `**` matches any number of path segments. An empty pattern
+// matches everything.
+func matchesGlob(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	if !strings.Contains(pattern, "**") {
+		matched, err := filepath.Match(pattern, value)
+		return err == nil && matched
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					expr.WriteString("(.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	matched, err := regexp.MatchString(expr.String(), value)
+	return err == nil && matched
+}
+
+// ResolveSuppressionsFile returns the suppressions file from the flag value or,
+// failing that, from the configuration file. It returns an empty string if
+// neither is set.
+func ResolveSuppressionsFile(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	configData, err := GetConfig()
+	if err != nil {
+		return ""
+	}
+	return configData.SuppressionsFile
+}
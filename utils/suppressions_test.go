@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+func TestSuppressDownloadedFindings(t *testing.T) {
+	results := models.Results{
+		ResositoriesWithFindings: []models.RepoWithFindings{
+			{Nwo: "octo/partial", RunId: 1, QueryId: "java/xss", Count: 5},
+			{Nwo: "octo/full", RunId: 1, QueryId: "java/xss", Count: 2},
+			{Nwo: "octo/other-run", RunId: 1, QueryId: "java/xss", Count: 3},
+			{Nwo: "octo/bundle", RunId: 3, QueryId: "suite", Count: 6},
+		},
+		TotalFindingsCount:            16,
+		TotalRepositoriesWithFindings: 4,
+	}
+	runs := []models.Run{
+		{Id: 1, QueryId: "java/xss"},
+		{Id: 3, QueryId: "suite", Queries: []models.RunQuery{{QueryId: "java/xss"}, {QueryId: "java/sqli"}}},
+	}
+	manifest := models.Manifest{Files: []models.ManifestEntry{
+		{Artifact: SarifArtifact, Nwo: "octo/partial", RunId: 1, QueryId: "java/xss", Suppressed: 2},
+		{Artifact: SarifArtifact, Nwo: "octo/full", RunId: 1, QueryId: "java/xss", Suppressed: 2},
+		{Artifact: SarifArtifact, Nwo: "octo/other-run", RunId: 2, QueryId: "java/xss", Suppressed: 3},
+		{Artifact: BqrsArtifact, Nwo: "octo/other-run", RunId: 1, QueryId: "java/xss", Suppressed: 3},
+		// the files of the queries bundled in a run
+		{Artifact: SarifArtifact, Nwo: "octo/bundle", RunId: 3, QueryId: "java/xss", Suppressed: 1},
+		{Artifact: SarifArtifact, Nwo: "octo/bundle", RunId: 3, QueryId: "java/sqli", Suppressed: 2},
+		{Artifact: SarifArtifact, Nwo: "octo/bundle", RunId: 3, QueryId: "java/other", Suppressed: 3},
+	}}
+	SuppressDownloadedFindings(&results, manifest, runs)
+	if results.TotalFindingsCount != 9 || results.TotalSuppressedFindingsCount != 7 {
+		t.Errorf("findings = %d, suppressed = %d, want 9, 7", results.TotalFindingsCount, results.TotalSuppressedFindingsCount)
+	}
+	if results.TotalRepositoriesWithFindings != 3 || results.TotalSuppressedRepositories != 1 {
+		t.Errorf("repositories = %d, suppressed = %d, want 3, 1", results.TotalRepositoriesWithFindings, results.TotalSuppressedRepositories)
+	}
+	if len(results.ResositoriesWithFindings) != 3 || results.ResositoriesWithFindings[0].Count != 3 || results.ResositoriesWithFindings[2].Count != 3 {
+		t.Errorf("repositories with findings = %v", results.ResositoriesWithFindings)
+	}
+	if len(results.SuppressedRepositories) != 1 || results.SuppressedRepositories[0].Nwo != "octo/full" {
+		t.Errorf("suppressed repositories = %v", results.SuppressedRepositories)
+	}
+}
+
+func TestLoadSarifBaseline(t *testing.T) {
+	sarif := `{"runs": [{%s"results": [{"ruleId": "java/xss", "locations": [{"physicalLocation": {"artifactLocation": {"uri": "src/Main.java"}}}]}]}]}`
+	provenance := `"versionControlProvenance": [{"repositoryUri": "https://github.com/octo/provenance"}], `
+	tests := []struct {
+		name     string
+		content  string
+		manifest string
+		want     string
+	}{
+		{"repository of the provenance", provenance, "", "octo/provenance"},
+		{"repository of the manifest", "", `{"files": [{"path": "results/octo_repo_1.sarif", "artifact": "sarif", "nwo": "octo/repo"}]}`, "octo/repo"},
+		{"unknown repository", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "results", "octo_repo_1.sarif")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(fmt.Sprintf(sarif, tt.content)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.manifest != "" {
+				if err := os.WriteFile(filepath.Join(dir, ManifestFilename), []byte(tt.manifest), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			baseline, err := LoadSuppressions(path)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("LoadSuppressions = %v, want an error", baseline)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(baseline) != 1 || baseline[0].Repository != tt.want || baseline[0].Rule != "java/xss" {
+				t.Errorf("LoadSuppressions = %v, want one java/xss entry for %s", baseline, tt.want)
+			}
+		})
+	}
+}
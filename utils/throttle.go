@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GitHubSecurityLab/gh-mrva/config"
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+var (
+	downloadTransportLock sync.Mutex
+	downloadTransport     http.RoundTripper
+)
+
+// DownloadTransport returns the transport shared by all the requests made while
+// downloading results and databases, so that the bandwidth and connection
+// limits apply to all of them together.
+func DownloadTransport() http.RoundTripper {
+	downloadTransportLock.Lock()
+	defer downloadTransportLock.Unlock()
+	if downloadTransport == nil {
+		downloadTransport = newThrottledTransport(models.DownloadLimits{
+			ArtifactWorkers: config.ARTIFACT_WORKERS,
+			DatabaseWorkers: config.DATABASE_WORKERS,
+		})
+	}
+	return debugTransport(downloadTransport)
+}
+
+// SetDownloadLimits replaces the shared download transport with one enforcing
+// the given limits. It must be called before any download starts.
+func SetDownloadLimits(limits models.DownloadLimits) {
+	downloadTransportLock.Lock()
+	defer downloadTransportLock.Unlock()
+	downloadTransport = newThrottledTransport(limits)
+}
+
+// ResolveDownloadLimits combines the flag values with the configuration file
+// and the defaults. Zero and empty flag values are considered unset.
+func ResolveDownloadLimits(artifactWorkers int, databaseWorkers int, bandwidthLimit string, maxConnectionsPerHost int) (models.DownloadLimits, error) {
+	configData, err := GetConfig()
+	if err != nil {
+		return models.DownloadLimits{}, err
+	}
+	limits := models.DownloadLimits{
+		ArtifactWorkers:       firstPositive(artifactWorkers, configData.ArtifactWorkers, config.ARTIFACT_WORKERS),
+		DatabaseWorkers:       firstPositive(databaseWorkers, configData.DatabaseWorkers, config.DATABASE_WORKERS),
+		MaxConnectionsPerHost: firstPositive(maxConnectionsPerHost, configData.MaxConnectionsPerHost, 0),
+	}
+	if artifactWorkers < 0 || databaseWorkers < 0 || maxConnectionsPerHost < 0 {
+		return limits, errors.New("Worker and connection limits must be positive")
+	}
+	if bandwidthLimit == "" {
+		bandwidthLimit = configData.BandwidthLimit
+	}
+	if bandwidthLimit != "" {
+		bytesPerSecond, err := ParseByteSize(bandwidthLimit)
+		if err != nil {
+			return limits, fmt.Errorf("Invalid bandwidth limit %q: %v", bandwidthLimit, err)
+		}
+		limits.BandwidthLimit = bytesPerSecond
+	}
+	return limits, nil
+}
+
+func firstPositive(values ...int) int {
+	for _, value := range values {
+		if value > 0 {
+			return value
+		}
+	}
+	return 0
+}
+
+// ParseByteSize parses sizes such as 512K, 10M or 1.5G. Sizes without a
+// suffix are in bytes.
+func ParseByteSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	size = strings.TrimSuffix(strings.TrimSuffix(size, "B"), "I")
+	multiplier := int64(1)
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			size = size[:len(size)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(size), 64)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, errors.New("size must be positive")
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// throttledTransport limits the number of connections per host and the total
+// bandwidth, and backs off when the API reports that it is rate limiting us.
+type throttledTransport struct {
+	base      http.RoundTripper
+	bandwidth *bandwidthLimiter
+
+	lock        sync.Mutex
+	cond        *sync.Cond
+	limit       int
+	maxLimit    int
+	inFlight    int
+	successes   int
+	pausedUntil time.Time
+}
+
+func newThrottledTransport(limits models.DownloadLimits) *throttledTransport {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.MaxConnsPerHost = limits.MaxConnectionsPerHost
+	base.MaxIdleConnsPerHost = limits.ArtifactWorkers + limits.DatabaseWorkers
+	maxLimit := limits.ArtifactWorkers + limits.DatabaseWorkers
+	if maxLimit < 1 {
+		maxLimit = 1
+	}
+	transport := &throttledTransport{
+		base:     base,
+		limit:    maxLimit,
+		maxLimit: maxLimit,
+	}
+	transport.cond = sync.NewCond(&transport.lock)
+	if limits.BandwidthLimit > 0 {
+		transport.bandwidth = &bandwidthLimiter{rate: limits.BandwidthLimit}
+	}
+	return transport
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		t.acquire()
+		resp, err := t.base.RoundTrip(req)
+		rateLimited := err == nil && isRateLimited(resp)
+		delay := time.Duration(0)
+		if rateLimited {
+			delay = retryDelay(resp, attempt)
+		}
+		t.adjust(rateLimited, delay)
+		if err != nil {
+			t.release()
+			return nil, err
+		}
+		if !rateLimited || attempt >= config.MAX_RETRIES || !isReplayable(req) {
+			// the request keeps its slot until its body is read, so that a
+			// lower limit also slows down the downloads in progress
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: t.release}
+			if t.bandwidth != nil {
+				resp.Body = &throttledBody{ReadCloser: resp.Body, limiter: t.bandwidth}
+			}
+			return resp, nil
+		}
+		resp.Body.Close()
+		t.release()
+		Logf("Rate limited by %s, retrying in %s", req.URL.Host, delay)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// acquire waits until the pool is not paused and there is room for another
+// request under the current limit.
+func (t *throttledTransport) acquire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for {
+		if wait := time.Until(t.pausedUntil); wait > 0 {
+			t.lock.Unlock()
+			time.Sleep(wait)
+			t.lock.Lock()
+			continue
+		}
+		if t.inFlight < t.limit {
+			break
+		}
+		t.cond.Wait()
+	}
+	t.inFlight++
+}
+
+// release frees the slot of a request once its response is done.
+func (t *throttledTransport) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.inFlight--
+	t.cond.Broadcast()
+}
+
+// adjust halves the number of concurrent requests and pauses all of them when
+// rate limited, and slowly grows it back as requests succeed.
+func (t *throttledTransport) adjust(rateLimited bool, delay time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if rateLimited {
+		t.successes = 0
+		t.limit = t.limit / 2
+		if t.limit < 1 {
+			t.limit = 1
+		}
+		if pausedUntil := time.Now().Add(delay); pausedUntil.After(t.pausedUntil) {
+			t.pausedUntil = pausedUntil
+		}
+	} else if t.limit < t.maxLimit {
+		t.successes++
+		if t.successes >= t.limit {
+			t.successes = 0
+			t.limit++
+		}
+	}
+	t.cond.Broadcast()
+}
+
+func isRateLimited(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return resp.StatusCode == http.StatusForbidden &&
+		(resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0")
+}
+
+// retryDelay honors the Retry-After and X-RateLimit-Reset headers, and
+// otherwise backs off exponentially.
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if delay := time.Until(time.Unix(reset, 0)); delay > 0 {
+				return delay
+			}
+		}
+	}
+	delay := time.Duration(config.MIN_BACKOFF_SECONDS) * time.Second << attempt
+	if maxDelay := time.Duration(config.MAX_BACKOFF_SECONDS) * time.Second; delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func isReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// releasingBody releases the slot of a request when its body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// bandwidthLimiter spreads reads over time so that all the responses together
+// stay under rate bytes per second.
+type bandwidthLimiter struct {
+	lock sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func (l *bandwidthLimiter) wait(n int) {
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	l.lock.Unlock()
+	time.Sleep(wait)
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	limiter *bandwidthLimiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	// read in small chunks so that the limit is applied smoothly
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+)
+
+func TestThrottledTransportHoldsSlotUntilBodyClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: newThrottledTransport(models.DownloadLimits{ArtifactWorkers: 1})}
+
+	first, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		second, err := client.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		second.Body.Close()
+	}()
+	select {
+	case <-done:
+		t.Fatal("the second request ran while the body of the first one was open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Body.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second request did not run after the first body was closed")
+	}
+}
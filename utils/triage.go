@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/GitHubSecurityLab/gh-mrva/models"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	triageFilePath string
+	TriageStates   = []string{"untriaged", "confirmed", "false-positive", "wont-fix"}
+)
+
+func GetTriageFilePath() string {
+	return triageFilePath
+}
+
+func SetTriageFilePath(path string) {
+	triageFilePath = path
+}
+
+// TriageKey identifies a finding across downloads of the same repository.
+func TriageKey(nwo string, finding models.Finding) string {
+	if finding.Fingerprint != "" {
+		return fmt.Sprintf("%s|%s|%s|%s", nwo, finding.RuleId, finding.Path, finding.Fingerprint)
+	}
+	return fmt.Sprintf("%s|%s|%s:%d", nwo, finding.RuleId, finding.Path, finding.StartLine)
+}
+
+func GetTriage() (map[string]string, error) {
+	triage := make(map[string]string)
+	triageFile, err := os.ReadFile(triageFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return triage, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(triageFile, &triage)
+	if err != nil {
+		return nil, err
+	}
+	if triage == nil {
+		triage = make(map[string]string)
+	}
+	return triage, nil
+}
+
+func SetTriageState(key string, state string) error {
+	triage, err := GetTriage()
+	if err != nil {
+		return err
+	}
+	if state == "" || state == TriageStates[0] {
+		delete(triage, key)
+	} else {
+		triage[key] = state
+	}
+	triageYaml, err := yaml.Marshal(triage)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(triageFilePath, triageYaml, 0644)
+}
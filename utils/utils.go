@@ -3,7 +3,9 @@ package utils
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +13,7 @@ import (
 	"gopkg.in/yaml.v3"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -19,6 +22,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/GitHubSecurityLab/gh-mrva/config"
 	"github.com/GitHubSecurityLab/gh-mrva/models"
 	"github.com/cli/go-gh"
 	"github.com/cli/go-gh/pkg/api"
@@ -75,6 +79,22 @@ func LoadRun(id int) (string, []models.Run, string, error) {
 	return "", nil, "", errors.New("No run found for " + fmt.Sprint(id))
 }
 
+// GetRunSessionName returns the name of the session a run belongs to.
+func GetRunSessionName(id int) string {
+	sessions, err := GetSessions()
+	if err != nil {
+		return ""
+	}
+	for name, session := range sessions {
+		for _, run := range session.Runs {
+			if run.Id == id {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
 func LoadSession(name string) (string, []models.Run, string, error) {
 	sessions, err := GetSessions()
 	if err != nil {
@@ -106,7 +126,9 @@ func GetSessionsStartingWith(prefix string) ([]string, error) {
 
 func GetRunDetails(controller string, runId int) (map[string]interface{}, error) {
 	opts := api.ClientOptions{
-		Headers: map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Host:      GetHost(),
+		Headers:   map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Transport: DownloadTransport(),
 	}
 	client, err := gh.RESTClient(&opts)
 	if err != nil {
@@ -122,7 +144,9 @@ func GetRunDetails(controller string, runId int) (map[string]interface{}, error)
 
 func GetRunRepositoryDetails(controller string, runId int, nwo string) (map[string]interface{}, error) {
 	opts := api.ClientOptions{
-		Headers: map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Host:      GetHost(),
+		Headers:   map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Transport: DownloadTransport(),
 	}
 	client, err := gh.RESTClient(&opts)
 	if err != nil {
@@ -136,7 +160,95 @@ func GetRunRepositoryDetails(controller string, runId int, nwo string) (map[stri
 	return response, nil
 }
 
-func SaveSession(name string, controller string, runs []models.Run, language string, listFile string, list string, query string, count int) error {
+// GetRepositoryStatuses lists the state of every repository targeted by a run,
+// including the repositories that were skipped.
+func GetRepositoryStatuses(run models.Run, runDetails map[string]interface{}) []models.RepoStatus {
+	var statuses []models.RepoStatus
+	scannedRepos, _ := runDetails["scanned_repositories"].([]interface{})
+	for _, r := range scannedRepos {
+		repo := r.(map[string]interface{})
+		repoInfo := repo["repository"].(map[string]interface{})
+		state, _ := repo["analysis_status"].(string)
+		resultCount, _ := repo["result_count"].(float64)
+		artifactSize, _ := repo["artifact_size_in_bytes"].(float64)
+		failureMessage, _ := repo["failure_message"].(string)
+		stars, _ := repoInfo["stargazers_count"].(float64)
+		if state == "succeeded" && resultCount == 0 {
+			state = "no-results"
+		}
+		statuses = append(statuses, models.RepoStatus{
+			RunId:          run.Id,
+			QueryId:        run.QueryId,
+			Nwo:            repoInfo["full_name"].(string),
+			State:          state,
+			FailureMessage: failureMessage,
+			ResultCount:    int(resultCount),
+			Stars:          int(stars),
+			ArtifactSize:   int(artifactSize),
+		})
+	}
+
+	skippedRepos, _ := runDetails["skipped_repositories"].(map[string]interface{})
+	for _, reason := range []string{"access_mismatch_repos", "not_found_repos", "no_codeql_db_repos", "over_limit_repos"} {
+		skipped, _ := skippedRepos[reason].(map[string]interface{})
+		var names []string
+		stars := make(map[string]int)
+		// not_found_repos only lists the names as they could not be resolved to repositories
+		fullNames, _ := skipped["repository_full_names"].([]interface{})
+		for _, name := range fullNames {
+			names = append(names, name.(string))
+		}
+		repos, _ := skipped["repositories"].([]interface{})
+		for _, r := range repos {
+			repoInfo := r.(map[string]interface{})
+			name := repoInfo["full_name"].(string)
+			names = append(names, name)
+			if count, ok := repoInfo["stargazers_count"].(float64); ok {
+				stars[name] = int(count)
+			}
+		}
+		for _, name := range names {
+			statuses = append(statuses, models.RepoStatus{
+				RunId:      run.Id,
+				QueryId:    run.QueryId,
+				Nwo:        name,
+				State:      "skipped",
+				SkipReason: strings.TrimSuffix(reason, "_repos"),
+				Stars:      stars[name],
+			})
+		}
+	}
+	return statuses
+}
+
+// FillDatabaseCommitShas looks up the commit of the database each analyzed
+// repository was scanned at, using the given number of workers.
+func FillDatabaseCommitShas(controller string, statuses []models.RepoStatus, workers int) {
+	wg := new(sync.WaitGroup)
+	indexes := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				repoDetails, err := GetRunRepositoryDetails(controller, statuses[i].RunId, statuses[i].Nwo)
+				if err != nil {
+					continue
+				}
+				statuses[i].DatabaseCommitSha, _ = repoDetails["database_commit_sha"].(string)
+			}
+		}()
+	}
+	for i, status := range statuses {
+		if status.State == "succeeded" || status.State == "no-results" || status.State == "failed" {
+			indexes <- i
+		}
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+func SaveSession(name string, controller string, runs []models.Run, language string, listFile string, list string, query string, count int, codeqlVersion string, codeqlCLIVersion string) error {
 	sessions, err := GetSessions()
 	if err != nil {
 		return err
@@ -149,14 +261,18 @@ func SaveSession(name string, controller string, runs []models.Run, language str
 		return errors.New(fmt.Sprintf("Session '%s' already exists", name))
 	} else {
 		sessions[name] = models.Session{
-			Name:            name,
-			Runs:            runs,
-			Timestamp:       time.Now(),
-			Controller:      controller,
-			Language:        language,
-			ListFile:        listFile,
-			List:            list,
-			RepositoryCount: count,
+			Name:             name,
+			Runs:             runs,
+			Timestamp:        time.Now(),
+			Controller:       controller,
+			Language:         language,
+			ListFile:         listFile,
+			List:             list,
+			RepositoryCount:  count,
+			CodeQLVersion:    codeqlVersion,
+			CodeQLCLIVersion: codeqlCLIVersion,
+			Profile:          activeProfile,
+			Host:             GetHost(),
 		}
 	}
 	// marshal sessions to yaml
@@ -174,7 +290,9 @@ func SaveSession(name string, controller string, runs []models.Run, language str
 
 func SubmitRun(controller string, language string, repoChunk []string, bundle string, actionBranch string) (int, error) {
 	opts := api.ClientOptions{
-		Headers: map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Host:      GetHost(),
+		Headers:   map[string]string{"Accept": "application/vnd.github.v3+json"},
+		Transport: APITransport(),
 	}
 	client, err := gh.RESTClient(&opts)
 	if err != nil {
@@ -205,21 +323,8 @@ func SubmitRun(controller string, language string, repoChunk []string, bundle st
 	return id, nil
 }
 
-func GetConfig() (models.Config, error) {
-	configFile, err := os.ReadFile(configFilePath)
-	var configData models.Config
-	if err != nil {
-		return configData, err
-	}
-	err = yaml.Unmarshal(configFile, &configData)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return configData, nil
-}
-
 func ResolveRepositories(listFile string, list string) ([]string, error) {
-	fmt.Printf("Resolving %s repositories from %s\n", list, listFile)
+	Printf("Resolving %s repositories from %s\n", list, listFile)
 	jsonFile, err := os.Open(listFile)
 	if err != nil {
 		return nil, err
@@ -234,25 +339,54 @@ func ResolveRepositories(listFile string, list string) ([]string, error) {
 	return repoLists[list], nil
 }
 
-func ResolveQueryId(queryFile string) (string, error) {
-	queryId := ""
+// ResolveQueryMetadata returns the metadata declared in the header of a query.
+func ResolveQueryMetadata(queryFile string) (map[string]string, error) {
 	args := []string{"resolve", "metadata", "--format=json", queryFile}
-	fmt.Println("Resolving query id for", queryFile)
+	logger.Debug("Resolving query metadata", "query", queryFile)
 	jsonBytes, err := RunCodeQLCommand("", true, args...)
-	fmt.Println("Metadata:", string(jsonBytes))
-	var metadata map[string]interface{}
+	logger.Debug("Resolved query metadata", "query", queryFile, "metadata", strings.TrimSpace(string(jsonBytes)))
 	if strings.TrimSpace(string(jsonBytes)) == "" {
-		fmt.Println("No metadata found in the specified query file.")
-		os.Exit(1)
+		return nil, errors.New("No metadata found in the specified query file.")
 	}
-	err = json.Unmarshal(jsonBytes, &metadata)
+	var rawMetadata map[string]interface{}
+	err = json.Unmarshal(jsonBytes, &rawMetadata)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
+	metadata := make(map[string]string)
+	for key, value := range rawMetadata {
+		if s, ok := value.(string); ok {
+			metadata[key] = s
+		}
+	}
+	return metadata, nil
+}
 
-	if _, ok := metadata["id"]; ok {
-		queryId = metadata["id"].(string)
+// GetRunMetadata returns the query metadata recorded for a run. Runs submitted
+// before the metadata was stored in the session fall back to resolving it from
+// the query file, if it is still available.
+func GetRunMetadata(run models.Run) map[string]string {
+	if len(run.Metadata) > 0 {
+		return run.Metadata
+	}
+	if _, err := os.Stat(run.Query); err != nil {
+		return nil
+	}
+	metadata, err := ResolveQueryMetadata(run.Query)
+	if err != nil {
+		Printf("Failed to resolve the metadata of %s: %v\n", run.Query, err)
+		return nil
+	}
+	return metadata
+}
+
+func ResolveQueryId(queryFile string) (string, error) {
+	metadata, err := ResolveQueryMetadata(queryFile)
+	if err != nil {
+		Fatalf("%v", err)
+	}
+
+	if queryId, ok := metadata["id"]; ok {
 		return queryId, nil
 	} else {
 		return "", errors.New("Failed to find query id in query file")
@@ -264,13 +398,11 @@ func ResolveQueries(additionalPacks string, querySuite string) []string {
 	jsonBytes, err := RunCodeQLCommand(additionalPacks, false, args...)
 	var queries []string
 	if strings.TrimSpace(string(jsonBytes)) == "" {
-		fmt.Println("No queries found in the specified query suite.")
-		os.Exit(1)
+		Fatalf("No queries found in the specified query suite.")
 	}
 	err = json.Unmarshal(jsonBytes, &queries)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		Fatalf("%v", err)
 	}
 	return queries
 }
@@ -282,17 +414,46 @@ func RunCodeQLCommand(additionalPacks string, combined bool, args ...string) ([]
 	if strings.Contains(strings.Join(args, " "), "pack install") {
 		args = append(args, "--no-strict-mode")
 	}
-	cmd := exec.Command("codeql", args...)
+	if _, err := CheckCodeQLVersion(""); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(codeqlCLI, args...)
 	cmd.Env = os.Environ()
+	// keep both streams for the log while returning what the caller asked for
+	var stdout, stderr, output bytes.Buffer
+	cmd.Stdout = io.MultiWriter(&stdout, &output)
 	if combined {
-		return cmd.CombinedOutput()
+		cmd.Stderr = io.MultiWriter(&stderr, &output)
 	} else {
-		return cmd.Output()
+		cmd.Stderr = &stderr
+	}
+	start := time.Now()
+	err := cmd.Run()
+	logger.Debug("codeql", "args", strings.Join(args, " "), "duration", time.Since(start), "error", err, "stdout", stdout.String(), "stderr", stderr.String())
+	if exitErr, ok := err.(*exec.ExitError); ok && !combined {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return output.Bytes(), err
+}
+
+func GenerateQueryPack(queryFile string, language string, additionalPacks string, modelPacks []PackRef) (string, map[string]string, error) {
+	bundle, queries, err := GenerateSuitePack([]string{queryFile}, language, additionalPacks, modelPacks)
+	if err != nil {
+		return "", nil, err
 	}
+	return bundle, queries[0].Metadata, nil
 }
 
-func GenerateQueryPack(queryFile string, language string, additionalPacks string) (string, string, error) {
-	fmt.Printf("Generating query pack for %s\n", queryFile)
+// GenerateSuitePack bundles several queries of the same pack in a single query
+// pack whose default suite runs them all, and returns the bundle with the id
+// and metadata of each query. The query pack depends on the model packs, so
+// that their data extensions are bundled with it.
+func GenerateSuitePack(queryFiles []string, language string, additionalPacks string, modelPacks []PackRef) (string, []models.RunQuery, error) {
+	if len(queryFiles) == 1 {
+		Printf("Generating query pack for %s\n", queryFiles[0])
+	} else {
+		Printf("Generating query pack for %d queries\n", len(queryFiles))
+	}
 
 	// create a temporary directory to hold the query pack
 	queryPackDir, err := os.MkdirTemp("", "query-pack-")
@@ -301,46 +462,73 @@ func GenerateQueryPack(queryFile string, language string, additionalPacks string
 	}
 	defer os.RemoveAll(queryPackDir)
 
-	queryFile, err = filepath.Abs(queryFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if _, err := os.Stat(queryFile); errors.Is(err, os.ErrNotExist) {
-		log.Fatal(fmt.Sprintf("Query file %s does not exist", queryFile))
-	}
-	queryId, err := ResolveQueryId(queryFile)
-	if err != nil {
-		log.Fatal(err)
+	var queries []models.RunQuery
+	var absQueryFiles []string
+	var packRelativePaths []string
+	originalPackRoot := ""
+	for _, query := range queryFiles {
+		queryFile, err := filepath.Abs(query)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := os.Stat(queryFile); errors.Is(err, os.ErrNotExist) {
+			log.Fatal(fmt.Sprintf("Query file %s does not exist", queryFile))
+		}
+		metadata, err := ResolveQueryMetadata(queryFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := metadata["id"]; !ok {
+			log.Fatal(fmt.Sprintf("Failed to find query id in query file %s", queryFile))
+		}
+		packRoot := FindPackRoot(queryFile)
+		if originalPackRoot == "" {
+			originalPackRoot = packRoot
+		} else if packRoot != originalPackRoot {
+			return "", nil, fmt.Errorf("The queries belong to several packs (%s and %s) and cannot be bundled in a single query pack", originalPackRoot, packRoot)
+		}
+		packRelativePath, _ := filepath.Rel(originalPackRoot, queryFile)
+		queries = append(queries, models.RunQuery{Query: query, QueryId: metadata["id"], Metadata: metadata})
+		absQueryFiles = append(absQueryFiles, queryFile)
+		packRelativePaths = append(packRelativePaths, packRelativePath)
 	}
-	originalPackRoot := FindPackRoot(queryFile)
-	packRelativePath, _ := filepath.Rel(originalPackRoot, queryFile)
-	targetQueryFileName := filepath.Join(queryPackDir, packRelativePath)
 
-	if _, err := os.Stat(filepath.Join(originalPackRoot, "qlpack.yml")); errors.Is(err, os.ErrNotExist) {
+	if packFile(originalPackRoot) == "" {
 		// qlpack.yml not found, generate a synthetic one
-		fmt.Printf("QLPack does not exist. Generating synthetic one for %s\n", queryFile)
-		// copy only the query file to the query pack directory
-		err := CopyFile(queryFile, targetQueryFileName)
-		if err != nil {
-			log.Fatal(err)
+		Printf("QLPack does not exist. Generating synthetic one for %s\n", originalPackRoot)
+		// copy only the query files to the query pack directory
+		var suiteQueries []string
+		for i, queryFile := range absQueryFiles {
+			err := CopyFile(queryFile, filepath.Join(queryPackDir, packRelativePaths[i]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			suiteQueries = append(suiteQueries, strings.Replace(packRelativePaths[i], string(os.PathSeparator), "/", -1))
 		}
 		// generate a synthetic qlpack.yml
 		td := struct {
 			Language string
 			Name     string
-			Query    string
+			Queries  []string
 		}{
 			Language: language,
 			Name:     "codeql-remote/query",
-			Query:    strings.Replace(packRelativePath, string(os.PathSeparator), "/", -1),
+			Queries:  suiteQueries,
 		}
 		t, err := template.New("").Parse(`name: {{ .Name }}
 version: 0.0.0
 dependencies:
   codeql/{{ .Language }}-all: "*"
 defaultSuite:
+{{- if eq (len .Queries) 1 }}
   description: Query suite for variant analysis
-  query: {{ .Query }}`)
+  query: {{ index .Queries 0 }}
+{{- else }}
+  - description: Query suite for variant analysis
+{{- range .Queries }}
+  - query: {{ . }}
+{{- end }}
+{{- end }}`)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -354,15 +542,24 @@ defaultSuite:
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Printf("Copied QLPack files to %s\n", queryPackDir)
+		logger.Debug("Copied QLPack files", "dir", queryPackDir)
 	} else {
-		// don't include all query files in the QLPacks. We only want the queryFile to be copied.
-		fmt.Printf("QLPack exists, stripping all other queries from %s\n", originalPackRoot)
+		// don't include all query files in the QLPacks. We only want the query files to be copied.
+		Printf("QLPack exists, stripping all other queries from %s\n", originalPackRoot)
 		toCopy := PackPacklist(originalPackRoot, false)
-		// also copy the lock file (either new name or old name) and the query file itself (these are not included in the packlist)
+		// also copy the lock file (either new name or old name) and the query files themselves (these are not included in the packlist)
 		lockFileNew := filepath.Join(originalPackRoot, "qlpack.lock.yml")
 		lockFileOld := filepath.Join(originalPackRoot, "codeql-pack.lock.yml")
-		candidateFiles := []string{lockFileNew, lockFileOld, queryFile}
+		candidateFiles := append([]string{lockFileNew, lockFileOld}, absQueryFiles...)
+		// and the data extensions of the pack, so that the remote runs use the same models as the local ones
+		dataExtensions, err := PackDataExtensions(originalPackRoot)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(dataExtensions) > 0 {
+			Printf("Including %d data extension files of %s\n", len(dataExtensions), originalPackRoot)
+		}
+		candidateFiles = append(candidateFiles, dataExtensions...)
 		for _, candidateFile := range candidateFiles {
 			if _, err := os.Stat(candidateFile); !errors.Is(err, os.ErrNotExist) {
 				// if the file exists, copy it
@@ -370,18 +567,24 @@ defaultSuite:
 			}
 		}
 		// copy the files to the queryPackDir directory
-		fmt.Printf("Preparing stripped QLPack in %s\n", queryPackDir)
+		logger.Debug("Preparing stripped QLPack", "dir", queryPackDir)
 		for _, srcPath := range toCopy {
 			relPath, _ := filepath.Rel(originalPackRoot, srcPath)
 			targetPath := filepath.Join(queryPackDir, relPath)
-			//fmt.Printf("Copying %s to %s\n", srcPath, targetPath)
+			//Printf("Copying %s to %s\n", srcPath, targetPath)
 			err := CopyFile(srcPath, targetPath)
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
-		fmt.Printf("Fixing QLPack in %s\n", queryPackDir)
-		FixPackFile(queryPackDir, packRelativePath)
+		logger.Debug("Fixing QLPack", "dir", queryPackDir)
+		FixPackFile(queryPackDir, packRelativePaths...)
+	}
+	if err := AddPackDependencies(queryPackDir, modelPacks); err != nil {
+		return "", nil, fmt.Errorf("Failed to add the model packs to the query pack: %v", err)
+	}
+	for _, modelPack := range modelPacks {
+		Printf("Using model pack %s\n", modelPack)
 	}
 
 	// assuming we are using 2.11.3 or later so Qlx remote is supported
@@ -390,36 +593,36 @@ defaultSuite:
 	bundlePath := filepath.Join(filepath.Dir(queryPackDir), fmt.Sprintf("qlpack-%s-generated.tgz", uuid.New().String()))
 
 	// install the pack dependencies
-	fmt.Print("Installing QLPack dependencies\n")
+	Print("Installing QLPack dependencies\n")
 	args := []string{"pack", "install", queryPackDir}
 	stdouterr, err := RunCodeQLCommand(additionalPacks, true, args...)
 	if err != nil {
-		fmt.Printf("`codeql pack bundle` failed with error: %v\n", string(stdouterr))
-		return "", "", fmt.Errorf("Failed to install query pack: %v", err)
+		Printf("`codeql pack bundle` failed with error: %v\n", string(stdouterr))
+		return "", nil, fmt.Errorf("Failed to install query pack: %v", err)
 	}
 	// bundle the query pack
-	fmt.Print("Compiling and bundling the QLPack (This may take a while)\n")
+	Print("Compiling and bundling the QLPack (This may take a while)\n")
 	args = []string{"pack", "bundle", "-o", bundlePath, queryPackDir}
 	args = append(args, precompilationOpts...)
 	stdouterr, err = RunCodeQLCommand(additionalPacks, true, args...)
 	if err != nil {
-		fmt.Printf("`codeql pack bundle` failed with error: %v\n", string(stdouterr))
-		return "", "", fmt.Errorf("Failed to bundle query pack: %v\n", err)
+		Printf("`codeql pack bundle` failed with error: %v\n", string(stdouterr))
+		return "", nil, fmt.Errorf("Failed to bundle query pack: %v\n", err)
 	}
 
 	// open the bundle file and encode it as base64
 	bundleFile, err := os.Open(bundlePath)
 	if err != nil {
-		return "", "", fmt.Errorf("Failed to open bundle file: %v\n", err)
+		return "", nil, fmt.Errorf("Failed to open bundle file: %v\n", err)
 	}
 	defer bundleFile.Close()
 	bundleBytes, err := io.ReadAll(bundleFile)
 	if err != nil {
-		return "", "", fmt.Errorf("Failed to read bundle file: %v\n", err)
+		return "", nil, fmt.Errorf("Failed to read bundle file: %v\n", err)
 	}
 	bundleBase64 := base64.StdEncoding.EncodeToString(bundleBytes)
 
-	return bundleBase64, queryId, nil
+	return bundleBase64, queries, nil
 }
 
 func PackPacklist(dir string, includeQueries bool) []string {
@@ -443,7 +646,7 @@ func FindPackRoot(queryFile string) string {
 	// If no qlpack.yml is found, return the directory of queryFile
 	currentDir := filepath.Dir(queryFile)
 	for currentDir != "/" {
-		if _, err := os.Stat(filepath.Join(currentDir, "qlpack.yml")); errors.Is(err, os.ErrNotExist) {
+		if packFile(currentDir) == "" {
 			// qlpack.yml not found, go up one level
 			currentDir = filepath.Dir(currentDir)
 		} else {
@@ -453,8 +656,11 @@ func FindPackRoot(queryFile string) string {
 	return filepath.Dir(queryFile)
 }
 
-func FixPackFile(queryPackDir string, packRelativePath string) error {
-	packPath := filepath.Join(queryPackDir, "qlpack.yml")
+func FixPackFile(queryPackDir string, packRelativePaths ...string) error {
+	packPath := packFile(queryPackDir)
+	if packPath == "" {
+		return errors.New("No qlpack.yml or codeql-pack.yml found in " + queryPackDir)
+	}
 	packFile, err := os.ReadFile(packPath)
 	if err != nil {
 		return err
@@ -470,9 +676,17 @@ func FixPackFile(queryPackDir string, packRelativePath string) error {
 		// remove the defaultSuiteFile property
 		delete(packData, "defaultSuiteFile")
 	}
-	packData["defaultSuite"] = map[string]string{
-		"query":       packRelativePath,
-		"description": "Query suite for Variant Analysis",
+	if len(packRelativePaths) == 1 {
+		packData["defaultSuite"] = map[string]string{
+			"query":       packRelativePaths[0],
+			"description": "Query suite for Variant Analysis",
+		}
+	} else {
+		suite := []map[string]string{{"description": "Query suite for Variant Analysis"}}
+		for _, packRelativePath := range packRelativePaths {
+			suite = append(suite, map[string]string{"query": packRelativePath})
+		}
+		packData["defaultSuite"] = suite
 	}
 
 	// update the name
@@ -523,113 +737,279 @@ func DownloadWorker(wg *sync.WaitGroup, taskChannel <-chan models.DownloadTask,
 	defer wg.Done()
 	for task := range taskChannel {
 		if task.Artifact == "artifact" {
-			DownloadResults(task)
+			task.Files, task.Err = DownloadResults(task)
 			resultChannel <- task
 		} else if task.Artifact == "database" {
-			fmt.Println("Downloading database", task.Nwo, task.Language, task.OutputDir, task.OutputFilename)
-			DownloadDatabase(task)
+			Logf("Downloading database for %s (%s)", task.Nwo, task.Language)
+			task.Files, task.Err = DownloadDatabase(task)
 			resultChannel <- task
 		}
 	}
 }
 
-func downloadArtifact(url string, task models.DownloadTask) error {
-	client, err := gh.HTTPClient(nil)
+func downloadArtifact(url string, task models.DownloadTask) ([]models.ManifestEntry, error) {
+	opts := api.ClientOptions{
+		Host:      GetHost(),
+		Transport: DownloadTransport(),
+	}
+	client, err := gh.HTTPClient(&opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	resp, err := client.Get(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to download artifact for %s: %s", task.Nwo, resp.Status)
+	}
 
-	body, err := io.ReadAll(resp.Body)
+	// stream the artifact to disk instead of holding it in memory
+	tmpFile, err := os.CreateTemp("", "mrva-artifact-*.zip")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	defer os.Remove(tmpFile.Name())
+	transfer := StartTransfer(task.Nwo+" results", resp.ContentLength)
+	defer transfer.Finish()
+	_, err = io.Copy(tmpFile, transfer.Reader(resp.Body))
+	tmpFile.Close()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	zipReader, err := zip.OpenReader(tmpFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	maxArtifactSize := task.MaxArtifactSize
+	if maxArtifactSize <= 0 {
+		maxArtifactSize = config.MAX_ARTIFACT_SIZE_MB * 1024 * 1024
 	}
+	remaining := maxArtifactSize
 
-	downloadedFiles := []string{}
+	downloadedFiles := []models.ManifestEntry{}
 	for _, zf := range zipReader.File {
+		isResult := zf.Name == "results.sarif" || zf.Name == "results.bqrs"
+		if !isResult && !task.FullArtifact {
+			continue
+		}
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			return nil, fmt.Errorf("Refusing to extract %s from the artifact for %s: not a regular file", zf.Name, task.Nwo)
+		}
+		if zf.UncompressedSize64 > uint64(remaining) {
+			return nil, fmt.Errorf("Artifact for %s exceeds the maximum decompressed size of %d MB", task.Nwo, maxArtifactSize/(1024*1024))
+		}
 
-		if zf.Name != "results.sarif" && zf.Name != "results.bqrs" {
+		if !isResult {
+			artifactPath, err := ArtifactPath(task, FullArtifact)
+			if err != nil {
+				return nil, err
+			}
+			targetPath, err := SafeExtractPath(artifactPath, zf.Name)
+			if err != nil {
+				return nil, err
+			}
+			written, sha256sum, err := extractZipEntry(zf, targetPath, remaining)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to extract %s from the artifact for %s: %v", zf.Name, task.Nwo, err)
+			}
+			remaining -= written
+			downloadedFiles = append(downloadedFiles, NewManifestEntry(task, FullArtifact, targetPath, sha256sum))
 			continue
 		}
-		f, err := zf.Open()
+
+		content, err := readZipEntry(zf, remaining)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("Failed to extract %s from the artifact for %s: %v", zf.Name, task.Nwo, err)
 		}
-		defer f.Close()
-		content, err := io.ReadAll(f)
+		remaining -= int64(len(content))
+
+		artifactType := SarifArtifact
+		if zf.Name == "results.bqrs" {
+			artifactType = BqrsArtifact
+		}
+		resultPath, err := ArtifactPath(task, artifactType)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
-		outputDir := task.OutputDir
-		outputFilename := task.OutputFilename
-		if zf.Name == "results.bqrs" {
-			outputFilename = outputFilename + ".bqrs"
-		} else if zf.Name == "results.sarif" {
-			outputFilename = outputFilename + ".sarif"
+		// replace the synthetic remote query ids with the real query id, the
+		// queries bundled in a run keep their own ids
+		if artifactType == SarifArtifact && len(task.Queries) == 0 {
+			rewrittenContent, err := RewriteSarifQueryId(content, task.QueryId, task.QueryMetadata)
+			if err != nil {
+				Logf("Failed to rewrite the query id in %s: %v", resultPath, err)
+			} else {
+				content = rewrittenContent
+			}
 		}
 
-		// replace remote-query with real query id
-		content = bytes.Replace(content, []byte("remote-query"), []byte(task.QueryId), -1)
+		// the results of the queries bundled in the run are only written split by query id
+		if artifactType == SarifArtifact && len(task.Queries) > 0 {
+			var queryIds []string
+			for _, query := range task.Queries {
+				queryIds = append(queryIds, query.QueryId)
+			}
+			split, err := SplitSarifByQueryId(content, queryIds)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to split the results for %s by query: %v", task.Nwo, err)
+			}
+			for _, query := range task.Queries {
+				queryTask := task
+				queryTask.QueryId = query.QueryId
+				queryTask.QueryMetadata = query.Metadata
+				queryPath, err := QueryArtifactPath(task, query.QueryId)
+				if err != nil {
+					return nil, err
+				}
+				entry, err := writeResultFile(queryTask, artifactType, queryPath, split[query.QueryId])
+				if err != nil {
+					return nil, err
+				}
+				downloadedFiles = append(downloadedFiles, entry)
+			}
+			continue
+		}
 
-		resultPath := filepath.Join(outputDir, outputFilename)
-		err = os.WriteFile(resultPath, content, os.ModePerm)
+		entry, err := writeResultFile(task, artifactType, resultPath, content)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		downloadedFiles = append(downloadedFiles, resultPath)
+		downloadedFiles = append(downloadedFiles, entry)
 	}
 
 	if len(downloadedFiles) == 0 {
-		return errors.New("No results files found in artifact")
+		return nil, errors.New("No results files found in artifact")
 	} else {
-		fmt.Println("Downloaded", downloadedFiles)
-		return nil
+		Logf("Downloaded %d files for %s", len(downloadedFiles), task.Nwo)
+		return downloadedFiles, nil
+	}
+}
+
+// writeResultFile writes a results file, marking known false positives as
+// suppressed in SARIF files.
+func writeResultFile(task models.DownloadTask, artifactType string, resultPath string, content []byte) (models.ManifestEntry, error) {
+	suppressed := 0
+	if artifactType == SarifArtifact && len(suppressions) > 0 {
+		suppressedContent, suppressedCount, err := SuppressSarif(content, task.Nwo, suppressions)
+		if err != nil {
+			Logf("Failed to apply suppressions to %s: %v", resultPath, err)
+		} else if suppressedCount > 0 {
+			content = suppressedContent
+			suppressed = suppressedCount
+			Logf("Suppressed %d results in %s", suppressedCount, resultPath)
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(resultPath), 0755)
+	if err != nil {
+		return models.ManifestEntry{}, err
 	}
+	err = os.WriteFile(resultPath, content, os.ModePerm)
+	if err != nil {
+		return models.ManifestEntry{}, err
+	}
+	entry := NewManifestEntry(task, artifactType, resultPath, Sha256Sum(content))
+	entry.Suppressed = suppressed
+	return entry, nil
 }
 
-func DownloadResults(task models.DownloadTask) error {
+// readZipEntry reads a zip entry into memory, failing if it decompresses to
+// more than limit bytes.
+func readZipEntry(zf *zip.File, limit int64) ([]byte, error) {
+	f, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, errors.New("maximum decompressed size exceeded")
+	}
+	return content, nil
+}
+
+// extractZipEntry streams a zip entry to targetPath, failing if it
+// decompresses to more than limit bytes. It returns the number of bytes
+// written and their SHA-256 checksum.
+func extractZipEntry(zf *zip.File, targetPath string, limit int64) (int64, string, error) {
+	f, err := zf.Open()
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+	if err != nil {
+		return 0, "", err
+	}
+	out, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, "", err
+	}
+	defer out.Close()
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(out, hash), io.LimitReader(f, limit+1))
+	if err != nil {
+		return written, "", err
+	}
+	if written > limit {
+		out.Close()
+		os.Remove(targetPath)
+		return written, "", errors.New("maximum decompressed size exceeded")
+	}
+	return written, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func DownloadResults(task models.DownloadTask) ([]models.ManifestEntry, error) {
 	// download artifact (BQRS or SARIF)
 	runRepositoryDetails, err := GetRunRepositoryDetails(task.Controller, task.RunId, task.Nwo)
 	if err != nil {
-		return errors.New("Failed to get run repository details")
+		return nil, errors.New("Failed to get run repository details")
 	}
+	task.CommitSha, _ = runRepositoryDetails["database_commit_sha"].(string)
 	// download the results
-	err = downloadArtifact(runRepositoryDetails["artifact_url"].(string), task)
+	files, err := downloadArtifact(runRepositoryDetails["artifact_url"].(string), task)
 	if err != nil {
-		return errors.New("Failed to download artifact")
+		return nil, fmt.Errorf("Failed to download artifact: %v", err)
 	}
-	return nil
+	return files, nil
 }
 
-func DownloadDatabase(task models.DownloadTask) error {
-	targetPath := filepath.Join(task.OutputDir, fmt.Sprintf("%s_db.zip", task.OutputFilename))
-	opts := api.ClientOptions{
-		Headers: map[string]string{"Accept": "application/zip"},
+func DownloadDatabase(task models.DownloadTask) ([]models.ManifestEntry, error) {
+	targetPath, err := ArtifactPath(task, DatabaseArtifact)
+	if err != nil {
+		return nil, err
 	}
-	client, err := gh.HTTPClient(&opts)
+	// databases are shared between sessions through the database cache
+	cachedDatabase, err := CacheDatabase(task.Nwo, task.Language)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resp, err := client.Get(fmt.Sprintf("https://api.github.com/repos/%s/code-scanning/codeql/databases/%s", task.Nwo, task.Language))
+	err = os.MkdirAll(filepath.Dir(targetPath), 0755)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	content, err := io.ReadAll(resp.Body)
+	err = LinkFile(cachedDatabase.Path, targetPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = os.WriteFile(targetPath, content, os.ModePerm)
-	return nil
+	task.CommitSha = cachedDatabase.CommitSha
+	// databases cached before checksums were recorded are hashed now
+	sha256sum := cachedDatabase.Sha256
+	if sha256sum == "" {
+		sha256sum, err = Sha256File(cachedDatabase.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []models.ManifestEntry{NewManifestEntry(task, DatabaseArtifact, targetPath, sha256sum)}, nil
 }